@@ -0,0 +1 @@
+drop table inbound_update;
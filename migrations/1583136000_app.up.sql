@@ -0,0 +1,23 @@
+create table inbound_update
+(
+  id serial not null
+    constraint inbound_update_pkey
+    primary key,
+  bot_id integer not null,
+  update_id integer not null,
+  chat_id bigint not null,
+  payload text not null,
+  status varchar(16) not null default 'pending',
+  attempts integer not null default 0,
+  last_error text,
+  next_attempt_at timestamp with time zone not null default current_timestamp,
+  locked_at timestamp with time zone,
+  created_at timestamp with time zone default current_timestamp,
+  updated_at timestamp with time zone default current_timestamp,
+  constraint inbound_update_key unique(bot_id, update_id)
+);
+
+alter table inbound_update add foreign key (bot_id) references bot on delete cascade;
+
+create index inbound_update_status_idx on inbound_update (status, next_attempt_at);
+create index inbound_update_chat_idx on inbound_update (bot_id, chat_id, id);
@@ -0,0 +1 @@
+drop table outbound_message;
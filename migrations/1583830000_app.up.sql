@@ -0,0 +1,22 @@
+create table outbound_message
+(
+  id serial not null
+    constraint outbound_message_pkey
+    primary key,
+  bot_id integer not null,
+  chat_id bigint not null,
+  message_id integer,
+  payload text not null,
+  status varchar(16) not null default 'pending',
+  attempts integer not null default 0,
+  last_error text,
+  next_attempt_at timestamp with time zone not null default current_timestamp,
+  locked_at timestamp with time zone,
+  created_at timestamp with time zone default current_timestamp,
+  updated_at timestamp with time zone default current_timestamp
+);
+
+alter table outbound_message add foreign key (bot_id) references bot on delete cascade;
+
+create index outbound_message_status_idx on outbound_message (status, next_attempt_at);
+create index outbound_message_chat_idx on outbound_message (bot_id, chat_id, id);
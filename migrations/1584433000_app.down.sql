@@ -0,0 +1,3 @@
+alter table bot
+  drop column update_mode,
+  drop column update_offset;
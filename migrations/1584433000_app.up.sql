@@ -0,0 +1,3 @@
+alter table bot
+  add column update_mode varchar(10),
+  add column update_offset integer not null default 0;
@@ -0,0 +1,3 @@
+alter table bot
+  drop column webhook_id,
+  drop column webhook_secret;
@@ -0,0 +1,12 @@
+alter table bot
+  add column webhook_id varchar(64),
+  add column webhook_secret varchar(64);
+
+update bot set
+  webhook_id = md5(random()::text || clock_timestamp()::text || id::text),
+  webhook_secret = md5(random()::text || clock_timestamp()::text || token);
+
+alter table bot
+  alter column webhook_id set not null,
+  alter column webhook_secret set not null,
+  add constraint bot_webhook_id_key unique (webhook_id);
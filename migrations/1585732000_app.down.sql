@@ -0,0 +1,18 @@
+-- encrypted secrets do not fit varchar(100) and can't be decrypted here,
+-- unset encryption current_key and run rotate-keys to store them as plain text first
+do $$
+begin
+  if exists (select 1 from bot where token like 'enc:v1:%')
+    or exists (select 1 from connection where api_key like 'enc:v1:%' or mg_token like 'enc:v1:%') then
+    raise exception 'secrets are encrypted, unset encryption current_key and run rotate-keys before migrating down';
+  end if;
+end
+$$;
+
+alter table bot
+  drop column token_hash,
+  alter column token type varchar(100);
+
+alter table connection
+  alter column api_key type varchar(100),
+  alter column mg_token type varchar(100);
@@ -0,0 +1,8 @@
+alter table connection
+  alter column api_key type text,
+  alter column mg_token type text;
+
+alter table bot
+  alter column token type text,
+  add column token_hash varchar(64),
+  add constraint bot_token_hash_key unique (token_hash);
@@ -0,0 +1,2 @@
+alter table bot
+  add column group_mode varchar(10);
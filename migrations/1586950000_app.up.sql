@@ -0,0 +1,16 @@
+create table message_part
+(
+  id serial not null
+    constraint message_part_pkey
+    primary key,
+  bot_id integer not null,
+  chat_id bigint not null,
+  external_id varchar(32) not null,
+  message_id integer not null,
+  part integer not null,
+  created_at timestamp with time zone default current_timestamp
+);
+
+alter table message_part add foreign key (bot_id) references bot on delete cascade;
+
+create unique index message_part_external_idx on message_part (bot_id, external_id, part);
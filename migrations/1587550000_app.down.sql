@@ -0,0 +1,19 @@
+drop index message_map_message_idx;
+drop index message_map_external_idx;
+
+-- message part table kept only outbound messages, ids of inbound ones repeat across chats of the bot
+delete from message_map where direction = 'in';
+-- outbound external ids may repeat across chats as well, the latest mapping is kept
+delete from message_map m
+  using message_map newer
+  where newer.bot_id = m.bot_id and newer.external_id = m.external_id and newer.part = m.part and newer.id > m.id;
+
+alter table message_map
+  drop column mg_message_id,
+  drop column direction;
+
+alter sequence message_map_id_seq rename to message_part_id_seq;
+alter table message_map rename constraint message_map_pkey to message_part_pkey;
+alter table message_map rename to message_part;
+
+create unique index message_part_external_idx on message_part (bot_id, external_id, part);
@@ -0,0 +1,11 @@
+alter table message_part rename to message_map;
+alter table message_map rename constraint message_part_pkey to message_map_pkey;
+alter sequence message_part_id_seq rename to message_map_id_seq;
+
+alter table message_map
+  add column mg_message_id bigint,
+  add column direction varchar(3) not null default 'out';
+
+drop index message_part_external_idx;
+create unique index message_map_external_idx on message_map (bot_id, chat_id, external_id, part);
+create index message_map_message_idx on message_map (bot_id, chat_id, message_id);
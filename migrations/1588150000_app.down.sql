@@ -0,0 +1,3 @@
+alter table message_map
+  drop column kind,
+  drop column file_id;
@@ -0,0 +1,3 @@
+alter table message_map
+  add column kind varchar(16),
+  add column file_id varchar(64);
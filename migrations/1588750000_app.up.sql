@@ -0,0 +1,15 @@
+create table chat_state
+(
+  id serial not null
+    constraint chat_state_pkey
+    primary key,
+  bot_id integer not null,
+  chat_id bigint not null,
+  blocked boolean not null default false,
+  created_at timestamp with time zone default current_timestamp,
+  updated_at timestamp with time zone default current_timestamp
+);
+
+alter table chat_state add foreign key (bot_id) references bot on delete cascade;
+
+create unique index chat_state_chat_idx on chat_state (bot_id, chat_id);
@@ -0,0 +1 @@
+drop table crm_customer;
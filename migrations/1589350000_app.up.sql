@@ -0,0 +1,15 @@
+create table crm_customer
+(
+  id serial not null
+    constraint crm_customer_pkey
+    primary key,
+  connection_id integer not null,
+  user_external_id integer not null,
+  customer_id integer not null,
+  created_at timestamp with time zone default current_timestamp,
+  updated_at timestamp with time zone default current_timestamp
+);
+
+alter table crm_customer add foreign key (connection_id) references connection on delete cascade;
+
+create unique index crm_customer_user_idx on crm_customer (connection_id, user_external_id);
@@ -0,0 +1,3 @@
+alter table connection
+  drop column reconciled_at,
+  drop column reconciled_hash;
@@ -0,0 +1,3 @@
+alter table connection
+  add column reconciled_at timestamp with time zone,
+  add column reconciled_hash varchar(70);
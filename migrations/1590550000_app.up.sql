@@ -0,0 +1,2 @@
+alter table bot
+  add column webhook_migrated boolean not null default false;
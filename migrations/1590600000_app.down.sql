@@ -0,0 +1,2 @@
+alter table connection
+  drop column module_hash;
@@ -0,0 +1,2 @@
+alter table connection
+  add column module_hash varchar(70);
@@ -0,0 +1,2 @@
+alter table outbound_message
+  drop column external_id;
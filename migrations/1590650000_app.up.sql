@@ -0,0 +1,2 @@
+alter table outbound_message
+  add column external_id varchar(32);
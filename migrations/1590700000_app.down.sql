@@ -0,0 +1,2 @@
+alter table message_map
+  drop column read;
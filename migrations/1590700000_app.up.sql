@@ -0,0 +1,2 @@
+alter table message_map
+  add column read boolean not null default false;
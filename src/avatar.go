@@ -0,0 +1,318 @@
+package main
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// AvatarCacheMemory keeps proxied avatars in memory
+	AvatarCacheMemory = "memory"
+	// AvatarCacheLocal keeps proxied avatars on disk
+	AvatarCacheLocal = "local"
+
+	defaultAvatarCachePath = "./avatars"
+	// maxAvatarSize limits avatar downloaded from Telegram
+	maxAvatarSize = 5 << 20
+	// defaultAvatarMemorySize limits size of avatars kept in memory, in megabytes
+	defaultAvatarMemorySize = 64
+)
+
+var (
+	errNoAvatar     = errors.New("user has no avatar")
+	avatarCache     avatarStore
+	avatarCacheOnce sync.Once
+	avatarFetches   = &avatarFetchGroup{calls: map[string]*avatarFetch{}}
+)
+
+// avatar is the image served by the avatar proxy
+type avatar struct {
+	Data        []byte
+	ContentType string
+}
+
+// avatarStore caches avatars fetched from Telegram until they expire
+type avatarStore interface {
+	get(key string, ttl time.Duration) (avatar, bool)
+	set(key string, a avatar) error
+}
+
+func getAvatarCache() avatarStore {
+	avatarCacheOnce.Do(func() {
+		if config.AvatarProxy.Cache == AvatarCacheLocal {
+			path := config.AvatarProxy.Path
+			if path == "" {
+				path = defaultAvatarCachePath
+			}
+
+			avatarCache = &localAvatarStore{path: path}
+			return
+		}
+
+		size := config.AvatarProxy.MemorySize
+		if size <= 0 {
+			size = defaultAvatarMemorySize
+		}
+
+		avatarCache = newMemoryAvatarStore(int64(size) << 20)
+	})
+
+	return avatarCache
+}
+
+// getAvatarTTL returns how long avatar is served without asking Telegram, the same as users are refreshed
+func getAvatarTTL() time.Duration {
+	return time.Hour * time.Duration(config.UpdateInterval)
+}
+
+// getAvatarSignature signs avatar URL with bot token so that it can not be used to fetch other users avatars
+func getAvatarSignature(b *Bot, userID int) string {
+	mac := hmac.New(sha256.New, []byte(b.Token))
+	mac.Write([]byte("avatar:" + strconv.Itoa(userID)))
+
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// getAvatarProxyURL returns URL the transport serves avatar of Telegram user at
+func getAvatarProxyURL(b *Bot, userID int) string {
+	return fmt.Sprintf("https://%s/avatar/%d/%d/%s", config.HTTPServer.Host, b.ID, userID, getAvatarSignature(b, userID))
+}
+
+func avatarHandler(c *gin.Context) {
+	botID, _ := strconv.Atoi(c.Param("bot"))
+	userID, _ := strconv.Atoi(c.Param("user"))
+	if botID == 0 || userID == 0 {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	b := getBotByID(botID)
+	if b.ID == 0 || !hmac.Equal([]byte(c.Param("sig")), []byte(getAvatarSignature(b, userID))) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	a, err := getAvatar(b, userID)
+	if err == errNoAvatar {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		logger.Errorf("avatarHandler bot %d user %d: %s", botID, userID, err.Error())
+		c.AbortWithStatus(http.StatusBadGateway)
+		return
+	}
+
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(getAvatarTTL().Seconds())))
+	c.Data(http.StatusOK, a.ContentType, a.Data)
+}
+
+// getAvatar returns cached avatar of Telegram user or fetches the current one
+func getAvatar(b *Bot, userID int) (avatar, error) {
+	key := fmt.Sprintf("%d-%d", b.ID, userID)
+	store := getAvatarCache()
+
+	if a, ok := store.get(key, getAvatarTTL()); ok {
+		return a, nil
+	}
+
+	// concurrent requests for the avatar of the same user share one request to Telegram
+	return avatarFetches.do(key, func() (avatar, error) {
+		return fetchAvatar(b, userID, key, store)
+	})
+}
+
+func fetchAvatar(b *Bot, userID int, key string, store avatarStore) (avatar, error) {
+	_, fileURL, err := GetFileIDAndURL(b, userID)
+	if err != nil {
+		return avatar{}, err
+	}
+
+	if fileURL == "" {
+		return avatar{}, errNoAvatar
+	}
+
+	body, err := fetchFile(fileURL, maxAvatarSize)
+	if err != nil {
+		return avatar{}, err
+	}
+	defer body.Close()
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return avatar{}, err
+	}
+
+	a := avatar{Data: data, ContentType: http.DetectContentType(data)}
+	if err := store.set(key, a); err != nil {
+		logger.Errorf("getAvatar cache %s: %s", key, err.Error())
+	}
+
+	return a, nil
+}
+
+// avatarFetch is a fetch of an avatar other requests for the same avatar wait for
+type avatarFetch struct {
+	wg     sync.WaitGroup
+	avatar avatar
+	err    error
+}
+
+// avatarFetchGroup deduplicates concurrent fetches of the same avatar
+type avatarFetchGroup struct {
+	mu    sync.Mutex
+	calls map[string]*avatarFetch
+}
+
+func (g *avatarFetchGroup) do(key string, fn func() (avatar, error)) (avatar, error) {
+	g.mu.Lock()
+	if f, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		f.wg.Wait()
+
+		return f.avatar, f.err
+	}
+
+	f := &avatarFetch{}
+	f.wg.Add(1)
+	g.calls[key] = f
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		f.wg.Done()
+	}()
+
+	f.avatar, f.err = fn()
+
+	return f.avatar, f.err
+}
+
+type memoryAvatar struct {
+	avatar
+	key      string
+	cachedAt time.Time
+}
+
+// memoryAvatarStore keeps avatars in memory up to the size limit, least recently used ones are evicted first
+type memoryAvatarStore struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	items   map[string]*list.Element
+	recent  *list.List
+}
+
+func newMemoryAvatarStore(maxSize int64) *memoryAvatarStore {
+	return &memoryAvatarStore{maxSize: maxSize, items: map[string]*list.Element{}, recent: list.New()}
+}
+
+func (s *memoryAvatarStore) get(key string, ttl time.Duration) (avatar, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.items[key]
+	if !ok {
+		return avatar{}, false
+	}
+
+	item := el.Value.(*memoryAvatar)
+	if time.Since(item.cachedAt) > ttl {
+		s.remove(el)
+		return avatar{}, false
+	}
+
+	s.recent.MoveToFront(el)
+
+	return item.avatar, true
+}
+
+func (s *memoryAvatarStore) set(key string, a avatar) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.items[key]; ok {
+		s.remove(el)
+	}
+
+	if int64(len(a.Data)) > s.maxSize {
+		return nil
+	}
+
+	s.items[key] = s.recent.PushFront(&memoryAvatar{avatar: a, key: key, cachedAt: time.Now()})
+	s.size += int64(len(a.Data))
+
+	for s.size > s.maxSize {
+		s.remove(s.recent.Back())
+	}
+
+	return nil
+}
+
+func (s *memoryAvatarStore) remove(el *list.Element) {
+	item := s.recent.Remove(el).(*memoryAvatar)
+	delete(s.items, item.key)
+	s.size -= int64(len(item.Data))
+}
+
+// localAvatarStore keeps avatars in files, modification time tells when the avatar was fetched
+type localAvatarStore struct {
+	path string
+}
+
+func (s *localAvatarStore) get(key string, ttl time.Duration) (avatar, bool) {
+	name := filepath.Join(s.path, key)
+
+	info, err := os.Stat(name)
+	if err != nil || time.Since(info.ModTime()) > ttl {
+		return avatar{}, false
+	}
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return avatar{}, false
+	}
+
+	return avatar{Data: data, ContentType: http.DetectContentType(data)}, true
+}
+
+func (s *localAvatarStore) set(key string, a avatar) error {
+	if err := os.MkdirAll(s.path, 0755); err != nil {
+		return err
+	}
+
+	// readers never see a partially written file
+	tmp, err := ioutil.TempFile(s.path, key+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(a.Data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(s.path, key))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAvatar_signature(t *testing.T) {
+	b := &Bot{ID: 1, Token: "123123:Qwerty"}
+
+	sig := getAvatarSignature(b, 100)
+	assert.Len(t, sig, 32)
+	assert.Equal(t, sig, getAvatarSignature(b, 100))
+	assert.NotEqual(t, sig, getAvatarSignature(b, 101))
+	assert.NotEqual(t, sig, getAvatarSignature(&Bot{ID: 1, Token: "456456:Qwerty"}, 100))
+	assert.Contains(t, getAvatarProxyURL(b, 100), "/avatar/1/100/"+sig)
+}
+
+func TestAvatar_stores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "avatars")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	stores := []avatarStore{
+		newMemoryAvatarStore(1 << 20),
+		&localAvatarStore{path: dir},
+	}
+
+	for _, s := range stores {
+		_, ok := s.get("1-100", time.Hour)
+		assert.False(t, ok)
+
+		require.NoError(t, s.set("1-100", avatar{Data: []byte("\xff\xd8\xff\xe0"), ContentType: "image/jpeg"}))
+
+		a, ok := s.get("1-100", time.Hour)
+		if assert.True(t, ok) {
+			assert.Equal(t, "image/jpeg", a.ContentType)
+			assert.Equal(t, []byte("\xff\xd8\xff\xe0"), a.Data)
+		}
+
+		time.Sleep(time.Millisecond)
+		_, ok = s.get("1-100", time.Nanosecond)
+		assert.False(t, ok)
+	}
+}
+
+func TestAvatar_memoryStoreEviction(t *testing.T) {
+	s := newMemoryAvatarStore(8)
+
+	require.NoError(t, s.set("1-100", avatar{Data: []byte("1234")}))
+	require.NoError(t, s.set("1-101", avatar{Data: []byte("1234")}))
+
+	// recently read avatar is kept
+	_, ok := s.get("1-100", time.Hour)
+	assert.True(t, ok)
+
+	require.NoError(t, s.set("1-102", avatar{Data: []byte("1234")}))
+
+	_, ok = s.get("1-101", time.Hour)
+	assert.False(t, ok)
+	_, ok = s.get("1-100", time.Hour)
+	assert.True(t, ok)
+	assert.Equal(t, int64(8), s.size)
+
+	// avatar larger than the store is not kept
+	require.NoError(t, s.set("1-103", avatar{Data: []byte("123456789")}))
+	_, ok = s.get("1-103", time.Hour)
+	assert.False(t, ok)
+}
+
+func TestAvatar_fetchGroup(t *testing.T) {
+	g := &avatarFetchGroup{calls: map[string]*avatarFetch{}}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var calls int32
+
+	results := make(chan avatar, 2)
+	fetch := func() {
+		a, _ := g.do("1-100", func() (avatar, error) {
+			atomic.AddInt32(&calls, 1)
+			close(started)
+			<-release
+
+			return avatar{ContentType: "image/jpeg"}, nil
+		})
+		results <- a
+	}
+
+	go fetch()
+	<-started
+
+	// the second request joins the fetch in progress
+	go fetch()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	assert.Equal(t, "image/jpeg", (<-results).ContentType)
+	assert.Equal(t, "image/jpeg", (<-results).ContentType)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// telegramResponseTimeout limits waiting for Telegram to answer once request is sent,
+// it is longer than long polling timeout during which getUpdates has nothing to answer
+const telegramResponseTimeout = pollingTimeout*time.Second + 30*time.Second
+
+var (
+	// telegramHTTPClient is shared by Bot API clients of all bots so that connections to Telegram are reused
+	telegramHTTPClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:          200,
+			MaxIdleConnsPerHost:   100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: telegramResponseTimeout,
+			ExpectContinueTimeout: time.Second,
+		},
+	}
+
+	botAPIs = &botRegistry{bots: map[int]*botClient{}}
+)
+
+type botClient struct {
+	token string
+	api   *tgbotapi.BotAPI
+}
+
+// botRegistry keeps Bot API clients of bots, creating a client costs a getMe request
+type botRegistry struct {
+	mu   sync.Mutex
+	bots map[int]*botClient
+}
+
+// get returns client of the bot, it is created again when the token changed
+func (r *botRegistry) get(b *Bot) (*tgbotapi.BotAPI, error) {
+	r.mu.Lock()
+	c, ok := r.bots[b.ID]
+	r.mu.Unlock()
+
+	if ok && c.token == string(b.Token) {
+		return c.api, nil
+	}
+
+	api, err := tgbotapi.NewBotAPIWithClient(string(b.Token), telegramHTTPClient)
+	if err != nil {
+		return nil, err
+	}
+
+	api.Debug = config.Debug
+
+	r.mu.Lock()
+	r.bots[b.ID] = &botClient{token: string(b.Token), api: api}
+	r.mu.Unlock()
+
+	return api, nil
+}
+
+func (r *botRegistry) remove(botID int) {
+	r.mu.Lock()
+	delete(r.bots, botID)
+	r.mu.Unlock()
+}
+
+// getBotAPI returns Bot API client of the saved bot
+func getBotAPI(b *Bot) (*tgbotapi.BotAPI, error) {
+	return botAPIs.get(b)
+}
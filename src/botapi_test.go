@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/h2non/gock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBotAPI_registry(t *testing.T) {
+	defer gock.Off()
+	gock.InterceptClient(telegramHTTPClient)
+	defer gock.RestoreClient(telegramHTTPClient)
+
+	gock.New("https://api.telegram.org").
+		Post("/bot111:First/getMe").
+		Times(1).
+		Reply(200).
+		BodyString(`{"ok":true,"result":{"id":111,"is_bot":true,"first_name":"First","username":"FirstBot"}}`)
+	gock.New("https://api.telegram.org").
+		Post("/bot111:Second/getMe").
+		Times(1).
+		Reply(200).
+		BodyString(`{"ok":true,"result":{"id":111,"is_bot":true,"first_name":"First","username":"FirstBot"}}`)
+
+	r := &botRegistry{bots: map[int]*botClient{}}
+	b := &Bot{ID: 1, Token: "111:First"}
+
+	first, err := r.get(b)
+	require.NoError(t, err)
+
+	cached, err := r.get(b)
+	require.NoError(t, err)
+	assert.True(t, first == cached)
+
+	b.Token = "111:Second"
+	renewed, err := r.get(b)
+	require.NoError(t, err)
+	assert.False(t, first == renewed)
+	assert.Equal(t, "111:Second", renewed.Token)
+	assert.True(t, gock.IsDone())
+
+	r.remove(b.ID)
+	assert.Empty(t, r.bots)
+}
+
+func TestBotAPI_responseTimeout(t *testing.T) {
+	timeout := telegramHTTPClient.Transport.(*http.Transport).ResponseHeaderTimeout
+
+	assert.NotZero(t, timeout)
+	assert.True(t, timeout > pollingTimeout*time.Second)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"io/ioutil"
 	"path/filepath"
+	"time"
 
 	"github.com/op/go-logging"
 	"gopkg.in/yaml.v2"
@@ -10,15 +11,25 @@ import (
 
 // TransportConfig struct
 type TransportConfig struct {
-	Version        string           `yaml:"version"`
-	LogLevel       logging.Level    `yaml:"log_level"`
-	Database       DatabaseConfig   `yaml:"database"`
-	SentryDSN      string           `yaml:"sentry_dsn"`
-	HTTPServer     HTTPServerConfig `yaml:"http_server"`
-	Debug          bool             `yaml:"debug"`
-	UpdateInterval int              `yaml:"update_interval"`
-	ConfigAWS      ConfigAWS        `yaml:"config_aws"`
-	TransportInfo  TransportInfo    `yaml:"transport_info"`
+	Version         string             `yaml:"version"`
+	LogLevel        logging.Level      `yaml:"log_level"`
+	Database        DatabaseConfig     `yaml:"database"`
+	SentryDSN       string             `yaml:"sentry_dsn"`
+	HTTPServer      HTTPServerConfig   `yaml:"http_server"`
+	Debug           bool               `yaml:"debug"`
+	UpdateInterval  int                `yaml:"update_interval"`
+	UpdateMode      string             `yaml:"update_mode"`
+	ParseMode       string             `yaml:"parse_mode"`
+	ConfigAWS       ConfigAWS          `yaml:"config_aws"`
+	Storage         StorageConfig      `yaml:"storage"`
+	AvatarProxy     AvatarProxyConfig  `yaml:"avatar_proxy"`
+	ConnectionCache CacheConfig        `yaml:"connection_cache"`
+	TransportInfo   TransportInfo      `yaml:"transport_info"`
+	InboundQueue    QueueConfig        `yaml:"inbound_queue"`
+	OutboundQueue   QueueConfig        `yaml:"outbound_queue"`
+	Encryption      EncryptionConfig   `yaml:"encryption"`
+	CRMCustomers    CRMCustomersConfig `yaml:"crm_customers"`
+	Reconcile       ReconcileConfig    `yaml:"reconcile"`
 }
 
 type TransportInfo struct {
@@ -35,6 +46,38 @@ type ConfigAWS struct {
 	Bucket          string `yaml:"bucket"`
 	FolderName      string `yaml:"folder_name"`
 	ContentType     string `yaml:"content_type"`
+	Endpoint        string `yaml:"endpoint"`
+	ForcePathStyle  bool   `yaml:"force_path_style"`
+	ACL             string `yaml:"acl"`
+}
+
+// CacheConfig struct
+type CacheConfig struct {
+	TTL    int  `yaml:"ttl"`
+	Notify bool `yaml:"notify"`
+}
+
+// AvatarProxyConfig struct
+type AvatarProxyConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	Cache      string `yaml:"cache"`
+	Path       string `yaml:"path"`
+	MemorySize int    `yaml:"memory_size"`
+}
+
+// StorageConfig struct
+type StorageConfig struct {
+	Type string `yaml:"type"`
+	Path string `yaml:"path"`
+}
+
+// getPath returns directory of local storage
+func (s StorageConfig) getPath() string {
+	if s.Path != "" {
+		return s.Path
+	}
+
+	return defaultLocalStoragePath
 }
 
 // DatabaseConfig struct
@@ -49,8 +92,79 @@ type DatabaseConfig struct {
 
 // HTTPServerConfig struct
 type HTTPServerConfig struct {
-	Host   string `yaml:"host"`
-	Listen string `yaml:"listen"`
+	Host            string `yaml:"host"`
+	Listen          string `yaml:"listen"`
+	SessionSecret   string `yaml:"session_secret"`
+	SessionLifetime int    `yaml:"session_lifetime"`
+}
+
+// EncryptionConfig struct
+type EncryptionConfig struct {
+	CurrentKey string            `yaml:"current_key"`
+	Keys       map[string]string `yaml:"keys"`
+}
+
+// CRMCustomersConfig struct
+type CRMCustomersConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	CustomField string `yaml:"custom_field"`
+	Create      bool   `yaml:"create"`
+	Recheck     int    `yaml:"recheck"`
+}
+
+// ReconcileConfig struct
+type ReconcileConfig struct {
+	Interval int     `yaml:"interval"`
+	Rate     float64 `yaml:"rate"`
+}
+
+// QueueConfig struct
+type QueueConfig struct {
+	Workers       int `yaml:"workers"`
+	MaxAttempts   int `yaml:"max_attempts"`
+	PollInterval  int `yaml:"poll_interval"`
+	RetryDelay    int `yaml:"retry_delay"`
+	MaxRetryDelay int `yaml:"max_retry_delay"`
+	LockTimeout   int `yaml:"lock_timeout"`
+	Retention     int `yaml:"retention"`
+}
+
+// withDefaults returns copy of queue config with empty values filled
+func (q QueueConfig) withDefaults() QueueConfig {
+	if q.Workers <= 0 {
+		q.Workers = 4
+	}
+
+	if q.MaxAttempts <= 0 {
+		q.MaxAttempts = 10
+	}
+
+	if q.PollInterval <= 0 {
+		q.PollInterval = 1
+	}
+
+	if q.RetryDelay <= 0 {
+		q.RetryDelay = 5
+	}
+
+	if q.MaxRetryDelay <= 0 {
+		q.MaxRetryDelay = 600
+	}
+
+	if q.LockTimeout <= 0 {
+		q.LockTimeout = 300
+	}
+
+	if q.Retention <= 0 {
+		q.Retention = 24
+	}
+
+	return q
+}
+
+// getRetention returns how long finished items are kept in the queue
+func (q QueueConfig) getRetention() time.Duration {
+	return time.Duration(q.Retention) * time.Hour
 }
 
 // LoadConfig read configuration file
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	v5 "github.com/retailcrm/api-client-go/v5"
+	v1 "github.com/retailcrm/mg-transport-api-client-go/v1"
+)
+
+const (
+	// cacheNotifyChannel is Postgres channel replicas announce changed connections and bots in
+	cacheNotifyChannel = "mg_telegram_cache"
+
+	defaultConnectionCacheTTL = 60
+)
+
+var connections = newConnectionCache()
+
+// cachedConnection is connection row with API clients built from it
+type cachedConnection struct {
+	conn      Connection
+	mg        *v1.MgClient
+	crm       *v5.Client
+	expiresAt time.Time
+}
+
+// connectionCache keeps connections used by every webhook, entries expire after TTL
+// in case invalidation from another replica was missed
+type connectionCache struct {
+	mu       sync.RWMutex
+	byID     map[int]*cachedConnection
+	byClient map[string]int
+}
+
+func newConnectionCache() *connectionCache {
+	return &connectionCache{
+		byID:     map[int]*cachedConnection{},
+		byClient: map[string]int{},
+	}
+}
+
+func getConnectionCacheTTL() time.Duration {
+	if config.ConnectionCache.TTL > 0 {
+		return time.Duration(config.ConnectionCache.TTL) * time.Second
+	}
+
+	return defaultConnectionCacheTTL * time.Second
+}
+
+func (c *connectionCache) get(id int) *cachedConnection {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	item, ok := c.byID[id]
+	if !ok || time.Now().After(item.expiresAt) {
+		return nil
+	}
+
+	return item
+}
+
+func (c *connectionCache) getByClientID(clientID string) *cachedConnection {
+	c.mu.RLock()
+	id, ok := c.byClient[clientID]
+	c.mu.RUnlock()
+
+	if !ok {
+		return nil
+	}
+
+	return c.get(id)
+}
+
+// load reads connection from the database, missing connections are not cached
+func (c *connectionCache) load(conn *Connection) *cachedConnection {
+	if conn.ID == 0 {
+		return nil
+	}
+
+	mg := v1.New(conn.MGURL, string(conn.MGToken))
+	mg.Debug = config.Debug
+
+	crm := v5.New(conn.APIURL, string(conn.APIKEY))
+	crm.Debug = config.Debug
+
+	item := &cachedConnection{
+		conn:      *conn,
+		mg:        mg,
+		crm:       crm,
+		expiresAt: time.Now().Add(getConnectionCacheTTL()),
+	}
+
+	c.mu.Lock()
+	c.byID[conn.ID] = item
+	c.byClient[conn.ClientID] = conn.ID
+	c.mu.Unlock()
+
+	return item
+}
+
+func (c *connectionCache) remove(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if item, ok := c.byID[id]; ok {
+		delete(c.byClient, item.conn.ClientID)
+		delete(c.byID, id)
+	}
+}
+
+func (c *connectionCache) flush() {
+	c.mu.Lock()
+	c.byID = map[int]*cachedConnection{}
+	c.byClient = map[string]int{}
+	c.mu.Unlock()
+}
+
+// getCachedConnection returns connection by client ID, ID is zero if there is none
+func getCachedConnection(clientID string) *Connection {
+	item := connections.getByClientID(clientID)
+	if item == nil {
+		item = connections.load(getConnection(clientID))
+	}
+
+	if item == nil {
+		return &Connection{}
+	}
+
+	conn := item.conn
+
+	return &conn
+}
+
+// getCachedConnectionByID returns connection by ID, ID is zero if there is none
+func getCachedConnectionByID(id int) *Connection {
+	item := connections.get(id)
+	if item == nil {
+		item = connections.load(getConnectionById(id))
+	}
+
+	if item == nil {
+		return &Connection{}
+	}
+
+	conn := item.conn
+
+	return &conn
+}
+
+// getMGClient returns MG client of the connection
+func getMGClient(conn *Connection) *v1.MgClient {
+	if item := connections.get(conn.ID); item != nil && item.conn.MGURL == conn.MGURL && item.conn.MGToken == conn.MGToken {
+		return item.mg
+	}
+
+	client := v1.New(conn.MGURL, string(conn.MGToken))
+	client.Debug = config.Debug
+
+	return client
+}
+
+// getCRMClient returns retailCRM client of the connection
+func getCRMClient(conn *Connection) *v5.Client {
+	if item := connections.get(conn.ID); item != nil && item.conn.APIURL == conn.APIURL && item.conn.APIKEY == conn.APIKEY {
+		return item.crm
+	}
+
+	client := v5.New(conn.APIURL, string(conn.APIKEY))
+	client.Debug = config.Debug
+
+	return client
+}
+
+// invalidateConnection drops cached connection here and, when notifications are enabled, on other replicas
+func invalidateConnection(id int) {
+	connections.remove(id)
+	notifyCacheChange("connection", id)
+}
+
+// invalidateBot drops cached Bot API client and connection of the bot
+func invalidateBot(id, connectionID int) {
+	botAPIs.remove(id)
+	connections.remove(connectionID)
+	notifyCacheChange("bot", id)
+	notifyCacheChange("connection", connectionID)
+}
+
+func notifyCacheChange(kind string, id int) {
+	if !config.ConnectionCache.Notify || id == 0 {
+		return
+	}
+
+	err := orm.DB.Exec("SELECT pg_notify(?, ?)", cacheNotifyChannel, fmt.Sprintf("%s:%d", kind, id)).Error
+	if err != nil {
+		logger.Errorf("notifyCacheChange %s %d: %s", kind, id, err.Error())
+	}
+}
+
+// applyCacheNotification drops entry named in notification sent by another replica
+func applyCacheNotification(payload string) {
+	parts := strings.SplitN(payload, ":", 2)
+	if len(parts) != 2 {
+		return
+	}
+
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return
+	}
+
+	switch parts[0] {
+	case "connection":
+		connections.remove(id)
+	case "bot":
+		botAPIs.remove(id)
+	}
+}
+
+// startCacheListener listens for changes made by other replicas, nothing is started when notifications are disabled
+func startCacheListener() *Workers {
+	w := newWorkers()
+	if !config.ConnectionCache.Notify {
+		return w
+	}
+
+	listener := pq.NewListener(config.Database.Connection, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			logger.Error("cache listener:", err)
+		}
+	})
+
+	if err := listener.Listen(cacheNotifyChannel); err != nil {
+		logger.Error("cache listener:", err)
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer listener.Close()
+
+		for {
+			select {
+			case <-w.stop:
+				return
+			case n := <-listener.Notify:
+				// notifications sent while reconnecting are lost
+				if n == nil {
+					connections.flush()
+					continue
+				}
+
+				applyCacheNotification(n.Extra)
+			case <-time.After(time.Minute):
+				go listener.Ping()
+			}
+		}
+	}()
+
+	return w
+}
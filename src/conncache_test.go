@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnCache_clients(t *testing.T) {
+	c := newConnectionCache()
+	conn := &Connection{ID: 10, ClientID: "cache-client", MGURL: "https://mg.example.com", MGToken: "token", Active: true}
+
+	item := c.load(conn)
+	require.NotNil(t, item)
+	assert.True(t, item == c.get(10))
+	assert.True(t, item == c.getByClientID("cache-client"))
+	assert.Nil(t, c.load(&Connection{}))
+
+	c.remove(10)
+	assert.Nil(t, c.get(10))
+	assert.Nil(t, c.getByClientID("cache-client"))
+}
+
+func TestConnCache_getMGClient(t *testing.T) {
+	defer connections.flush()
+
+	conn := &Connection{ID: 11, ClientID: "cache-mg", MGURL: "https://mg.example.com", MGToken: "token"}
+	connections.load(conn)
+
+	client := getMGClient(conn)
+	assert.True(t, client == getMGClient(conn))
+
+	changed := *conn
+	changed.MGToken = "other"
+	assert.False(t, client == getMGClient(&changed))
+	assert.Equal(t, "other", getMGClient(&changed).Token)
+
+	applyCacheNotification("connection:11")
+	assert.Nil(t, connections.get(11))
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/retailcrm/api-client-go/errs"
+	v5 "github.com/retailcrm/api-client-go/v5"
+)
+
+const (
+	defaultCRMCustomerField   = "telegram_id"
+	defaultCRMCustomerRecheck = 24
+)
+
+// crmLookups keeps users being looked up so that messages of a user sent in a row make one lookup
+var crmLookups sync.Map
+
+// crmCustomer is retailCRM customer with custom fields in the form API expects,
+// the bundled client sends them as a list
+type crmCustomer struct {
+	v5.Customer
+	CustomFields map[string]string `json:"customFields,omitempty"`
+}
+
+func getCRMCustomerField() string {
+	if config.CRMCustomers.CustomField != "" {
+		return config.CRMCustomers.CustomField
+	}
+
+	return defaultCRMCustomerField
+}
+
+// failureError returns error of retailCRM API call, nil if the call succeeded
+func failureError(f errs.Failure) error {
+	if f.RuntimeErr != nil {
+		return f.RuntimeErr
+	}
+
+	if f.ApiErr != "" {
+		return errors.New(f.ApiErr)
+	}
+
+	return nil
+}
+
+func getCRMCustomerRecheck() time.Duration {
+	if config.CRMCustomers.Recheck > 0 {
+		return time.Duration(config.CRMCustomers.Recheck) * time.Hour
+	}
+
+	return defaultCRMCustomerRecheck * time.Hour
+}
+
+// isLookupDue returns true if user has to be looked up in CRM, user without a match is looked up again
+// after the recheck period or at once when the phone is shared
+func (c *CRMCustomer) isLookupDue(phone string, now time.Time) bool {
+	if c.ID == 0 {
+		return true
+	}
+
+	if c.CustomerID != 0 {
+		return false
+	}
+
+	return phone != "" || now.Sub(c.UpdatedAt) >= getCRMCustomerRecheck()
+}
+
+// linkCRMCustomerAsync links retailCRM customer in background so that inbound processing does not wait for CRM
+func linkCRMCustomerAsync(conn *Connection, from *tgbotapi.User, phone string) {
+	if !config.CRMCustomers.Enabled || from == nil || from.IsBot {
+		return
+	}
+
+	key := fmt.Sprintf("%d:%d", conn.ID, from.ID)
+	if _, running := crmLookups.LoadOrStore(key, true); running {
+		return
+	}
+
+	go func() {
+		defer crmLookups.Delete(key)
+		linkCRMCustomer(conn, from, phone)
+	}()
+}
+
+// linkCRMCustomer finds retailCRM customer of Telegram user or creates one, the result is stored
+// so that CRM is asked once per user, user without a match is marked with zero customer ID
+// and rechecked periodically, phone is used when customer shared the contact
+func linkCRMCustomer(conn *Connection, from *tgbotapi.User, phone string) {
+	if !getCRMCustomer(conn.ID, from.ID).isLookupDue(phone, time.Now()) {
+		return
+	}
+
+	client := getCRMClient(conn)
+
+	id, err := findCRMCustomer(client, getCRMCustomerField(), from, phone)
+	if err != nil {
+		logger.Errorf("linkCRMCustomer connection %d user %d: %s", conn.ID, from.ID, err.Error())
+		return
+	}
+
+	link := CRMCustomer{ConnectionID: conn.ID, UserExternalID: from.ID, CustomerID: id}
+	if err := link.save(); err != nil {
+		logger.Errorf("linkCRMCustomer connection %d user %d: %s", conn.ID, from.ID, err.Error())
+	}
+}
+
+// findCRMCustomer returns ID of retailCRM customer with Telegram user ID in the custom field,
+// customer found by phone gets the field filled, new customer is created if it is allowed
+func findCRMCustomer(client *v5.Client, field string, from *tgbotapi.User, phone string) (int, error) {
+	userID := strconv.Itoa(from.ID)
+
+	id, err := searchCRMCustomer(client, url.Values{fmt.Sprintf("filter[customFields][%s]", field): {userID}})
+	if err != nil || id != 0 {
+		return id, err
+	}
+
+	if phone != "" {
+		id, err = searchCRMCustomer(client, url.Values{"filter[name]": {phone}})
+		if err != nil {
+			return 0, err
+		}
+
+		if id != 0 {
+			customer := crmCustomer{Customer: v5.Customer{ID: id}, CustomFields: map[string]string{field: userID}}
+			_, err = saveCRMCustomer(client, fmt.Sprintf("/customers/%d/edit", id), customer, url.Values{"by": {"id"}})
+
+			return id, err
+		}
+	}
+
+	if !config.CRMCustomers.Create {
+		return 0, nil
+	}
+
+	customer := crmCustomer{
+		Customer: v5.Customer{
+			FirstName: from.FirstName,
+			LastName:  from.LastName,
+		},
+		CustomFields: map[string]string{field: userID},
+	}
+
+	if phone != "" {
+		customer.Phones = []v5.Phone{{Number: phone}}
+	}
+
+	return saveCRMCustomer(client, "/customers/create", customer, url.Values{})
+}
+
+// getSharedPhone returns phone number of the customer if the message shares own contact
+func getSharedPhone(m *Message) string {
+	if m.Contact == nil || m.From == nil || m.Contact.UserID != m.From.ID {
+		return ""
+	}
+
+	return m.Contact.PhoneNumber
+}
+
+// searchCRMCustomer returns ID of the first customer matching the filter, the bundled client
+// can not encode custom fields filter so the query is built here
+func searchCRMCustomer(client *v5.Client, filter url.Values) (int, error) {
+	filter.Set("limit", "20")
+
+	data, _, f := client.GetRequest("/customers?" + filter.Encode())
+	if err := failureError(f); err != nil {
+		return 0, err
+	}
+
+	var resp v5.CustomersResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return 0, err
+	}
+
+	if !resp.Success {
+		return 0, errors.New(string(data))
+	}
+
+	if len(resp.Customers) == 0 {
+		return 0, nil
+	}
+
+	return resp.Customers[0].ID, nil
+}
+
+func saveCRMCustomer(client *v5.Client, method string, customer crmCustomer, params url.Values) (int, error) {
+	customerJSON, err := json.Marshal(customer)
+	if err != nil {
+		return 0, err
+	}
+
+	params.Set("customer", string(customerJSON))
+
+	data, _, f := client.PostRequest(method, params)
+	if err := failureError(f); err != nil {
+		return 0, err
+	}
+
+	var resp v5.CustomerChangeResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return 0, err
+	}
+
+	if !resp.Success {
+		return 0, errors.New(string(data))
+	}
+
+	return resp.ID, nil
+}
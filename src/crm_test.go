@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/h2non/gock"
+	v5 "github.com/retailcrm/api-client-go/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCRM_findCRMCustomer(t *testing.T) {
+	defer gock.Off()
+
+	crmConfig := config.CRMCustomers
+	defer func() { config.CRMCustomers = crmConfig }()
+	config.CRMCustomers.Create = true
+
+	client := v5.New("https://crm.example.com", "key")
+	from := &tgbotapi.User{ID: 123, FirstName: "John", LastName: "Doe"}
+
+	gock.New("https://crm.example.com").
+		Get("/api/v5/customers").
+		MatchParam("filter[customFields][telegram_id]", "123").
+		Reply(200).
+		BodyString(`{"success":true,"customers":[{"id":10}]}`)
+
+	id, err := findCRMCustomer(client, "telegram_id", from, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, id)
+
+	gock.New("https://crm.example.com").
+		Get("/api/v5/customers").
+		MatchParam("filter[customFields][telegram_id]", "123").
+		Reply(200).
+		BodyString(`{"success":true,"customers":[]}`)
+	gock.New("https://crm.example.com").
+		Get("/api/v5/customers").
+		MatchParam("filter[name]", `\+79990000000`).
+		Reply(200).
+		BodyString(`{"success":true,"customers":[{"id":11}]}`)
+	gock.New("https://crm.example.com").
+		Post("/api/v5/customers/11/edit").
+		BodyString(`by=id&customer=.+telegram_id.+123`).
+		Reply(200).
+		BodyString(`{"success":true,"id":11}`)
+
+	id, err = findCRMCustomer(client, "telegram_id", from, "+79990000000")
+	assert.NoError(t, err)
+	assert.Equal(t, 11, id)
+
+	gock.New("https://crm.example.com").
+		Get("/api/v5/customers").
+		Reply(200).
+		BodyString(`{"success":true,"customers":[]}`)
+	gock.New("https://crm.example.com").
+		Post("/api/v5/customers/create").
+		BodyString(`customer=.+firstName.+John`).
+		Reply(200).
+		BodyString(`{"success":true,"id":12}`)
+
+	id, err = findCRMCustomer(client, "telegram_id", from, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 12, id)
+	assert.True(t, gock.IsDone())
+}
+
+func TestCRM_isLookupDue(t *testing.T) {
+	crmConfig := config.CRMCustomers
+	defer func() { config.CRMCustomers = crmConfig }()
+	config.CRMCustomers.Recheck = 1
+
+	now := time.Now()
+
+	assert.True(t, (&CRMCustomer{}).isLookupDue("", now))
+	assert.False(t, (&CRMCustomer{ID: 1, CustomerID: 10, UpdatedAt: now.Add(-48 * time.Hour)}).isLookupDue("+79990000000", now))
+
+	checked := &CRMCustomer{ID: 1, UpdatedAt: now.Add(-time.Minute)}
+	assert.False(t, checked.isLookupDue("", now))
+	assert.True(t, checked.isLookupDue("+79990000000", now))
+
+	checked.UpdatedAt = now.Add(-2 * time.Hour)
+	assert.True(t, checked.isLookupDue("", now))
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// encryptedPrefix marks values encrypted with a data key wrapped by a key from config.
+// Format: enc:v1:<key id>:<wrapped data key>:<ciphertext>
+const encryptedPrefix = "enc:v1:"
+
+var (
+	encryptionKeys       = map[string][]byte{}
+	currentEncryptionKey string
+)
+
+// EncryptedString is a string stored encrypted in the database
+type EncryptedString string
+
+// Value encrypts string before it is written to the database
+func (s EncryptedString) Value() (driver.Value, error) {
+	return encryptSecret(string(s))
+}
+
+// Scan decrypts string read from the database
+func (s *EncryptedString) Scan(src interface{}) error {
+	var value string
+
+	switch v := src.(type) {
+	case nil:
+	case string:
+		value = v
+	case []byte:
+		value = string(v)
+	default:
+		return fmt.Errorf("unsupported type %T for encrypted string", src)
+	}
+
+	plain, err := decryptSecret(value)
+	if err != nil {
+		return err
+	}
+
+	*s = EncryptedString(plain)
+
+	return nil
+}
+
+// setEncryptionKeys loads master keys from config, values are stored as plain text when no key is configured
+func setEncryptionKeys(ec EncryptionConfig) error {
+	keys := map[string][]byte{}
+
+	for id, encoded := range ec.Keys {
+		if strings.Contains(id, ":") {
+			return fmt.Errorf("encryption key id %s must not contain ':'", id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("encryption key %s: %s", id, err.Error())
+		}
+
+		if len(key) != 32 {
+			return fmt.Errorf("encryption key %s must be 32 bytes long", id)
+		}
+
+		keys[id] = key
+	}
+
+	if _, ok := keys[ec.CurrentKey]; ec.CurrentKey != "" && !ok {
+		return fmt.Errorf("current encryption key %s is not defined", ec.CurrentKey)
+	}
+
+	encryptionKeys = keys
+	currentEncryptionKey = ec.CurrentKey
+
+	return nil
+}
+
+func isEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+// secretHash returns lookup hash for a secret stored encrypted
+func secretHash(secret string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(secret)))
+}
+
+func encryptSecret(plain string) (string, error) {
+	if currentEncryptionKey == "" || plain == "" {
+		return plain, nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+
+	wrappedKey, err := seal(encryptionKeys[currentEncryptionKey], dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := seal(dataKey, []byte(plain))
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedPrefix + currentEncryptionKey + ":" +
+		base64.StdEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+func decryptSecret(value string) (string, error) {
+	if !isEncrypted(value) {
+		return value, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if len(parts) != 3 {
+		return "", errors.New("malformed encrypted value")
+	}
+
+	masterKey, ok := encryptionKeys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("unknown encryption key %s", parts[0])
+	}
+
+	wrappedKey, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+
+	dataKey, err := open(masterKey, wrappedKey)
+	if err != nil {
+		return "", err
+	}
+
+	plain, err := open(dataKey, ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plain), nil
+}
+
+// seal encrypts data with AES-GCM, nonce is prepended to the result
+func seal(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+func open(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testKeyA = base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 32)))
+	testKeyB = base64.StdEncoding.EncodeToString([]byte(strings.Repeat("b", 32)))
+)
+
+// withEncryptionKeys sets keys for the test and restores the previous ones afterwards
+func withEncryptionKeys(t *testing.T, ec EncryptionConfig) func() {
+	keys, current := encryptionKeys, currentEncryptionKey
+	require.NoError(t, setEncryptionKeys(ec))
+
+	return func() {
+		encryptionKeys, currentEncryptionKey = keys, current
+	}
+}
+
+func TestCrypto_roundTrip(t *testing.T) {
+	defer withEncryptionKeys(t, EncryptionConfig{CurrentKey: "a", Keys: map[string]string{"a": testKeyA}})()
+
+	value, err := EncryptedString("123123:Qwerty").Value()
+	require.NoError(t, err)
+
+	encrypted := value.(string)
+	assert.True(t, strings.HasPrefix(encrypted, encryptedPrefix+"a:"))
+	assert.NotContains(t, encrypted, "Qwerty")
+
+	other, err := encryptSecret("123123:Qwerty")
+	require.NoError(t, err)
+	assert.NotEqual(t, encrypted, other)
+
+	var s EncryptedString
+	require.NoError(t, s.Scan([]byte(encrypted)))
+	assert.Equal(t, EncryptedString("123123:Qwerty"), s)
+
+	// values written before encryption was enabled are read as they are
+	require.NoError(t, s.Scan("plain"))
+	assert.Equal(t, EncryptedString("plain"), s)
+
+	empty, err := encryptSecret("")
+	require.NoError(t, err)
+	assert.Empty(t, empty)
+}
+
+func TestCrypto_wrongKey(t *testing.T) {
+	defer withEncryptionKeys(t, EncryptionConfig{CurrentKey: "a", Keys: map[string]string{"a": testKeyA}})()
+
+	encrypted, err := encryptSecret("secret")
+	require.NoError(t, err)
+
+	// the same key id with different key material fails authentication
+	require.NoError(t, setEncryptionKeys(EncryptionConfig{CurrentKey: "a", Keys: map[string]string{"a": testKeyB}}))
+	_, err = decryptSecret(encrypted)
+	assert.Error(t, err)
+
+	require.NoError(t, setEncryptionKeys(EncryptionConfig{CurrentKey: "b", Keys: map[string]string{"b": testKeyB}}))
+	_, err = decryptSecret(encrypted)
+	assert.EqualError(t, err, "unknown encryption key a")
+
+	_, err = decryptSecret(encryptedPrefix + "b:broken")
+	assert.EqualError(t, err, "malformed encrypted value")
+}
+
+func TestCrypto_rotation(t *testing.T) {
+	defer withEncryptionKeys(t, EncryptionConfig{CurrentKey: "a", Keys: map[string]string{"a": testKeyA}})()
+
+	old, err := encryptSecret("secret")
+	require.NoError(t, err)
+
+	require.NoError(t, setEncryptionKeys(EncryptionConfig{CurrentKey: "b", Keys: map[string]string{"a": testKeyA, "b": testKeyB}}))
+
+	// old values are readable while the old key is configured and are written with the new one
+	plain, err := decryptSecret(old)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", plain)
+
+	rotated, err := encryptSecret(plain)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(rotated, encryptedPrefix+"b:"))
+
+	require.NoError(t, setEncryptionKeys(EncryptionConfig{CurrentKey: "b", Keys: map[string]string{"b": testKeyB}}))
+	plain, err = decryptSecret(rotated)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", plain)
+
+	// without current key secrets are written as plain text
+	require.NoError(t, setEncryptionKeys(EncryptionConfig{Keys: map[string]string{"b": testKeyB}}))
+	plain, err = encryptSecret("secret")
+	require.NoError(t, err)
+	assert.Equal(t, "secret", plain)
+}
+
+func TestCrypto_setEncryptionKeys(t *testing.T) {
+	defer withEncryptionKeys(t, EncryptionConfig{})()
+
+	assert.Error(t, setEncryptionKeys(EncryptionConfig{CurrentKey: "c", Keys: map[string]string{"a": testKeyA}}))
+	assert.Error(t, setEncryptionKeys(EncryptionConfig{Keys: map[string]string{"a:b": testKeyA}}))
+	assert.Error(t, setEncryptionKeys(EncryptionConfig{Keys: map[string]string{"a": base64.StdEncoding.EncodeToString([]byte("short"))}}))
+	assert.Error(t, setEncryptionKeys(EncryptionConfig{Keys: map[string]string{"a": "not base64"}}))
+}
+
+func TestCrypto_secretHash(t *testing.T) {
+	assert.Len(t, secretHash("123123:Qwerty"), 64)
+	assert.Equal(t, secretHash("123123:Qwerty"), secretHash("123123:Qwerty"))
+	assert.NotEqual(t, secretHash("123123:Qwerty"), secretHash("123123:Qwertz"))
+}
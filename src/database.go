@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"time"
 
 	"github.com/jinzhu/gorm"
@@ -14,6 +16,10 @@ type Orm struct {
 
 // NewDb init new database connection
 func NewDb(config *TransportConfig) *Orm {
+	if err := setEncryptionKeys(config.Encryption); err != nil {
+		panic(err)
+	}
+
 	db, err := gorm.Open("postgres", config.Database.Connection)
 	if err != nil {
 		panic(err)
@@ -35,3 +41,37 @@ func NewDb(config *TransportConfig) *Orm {
 func (orm *Orm) Close() {
 	orm.DB.Close()
 }
+
+// AdvisoryLock is a session level Postgres advisory lock held on a dedicated connection
+type AdvisoryLock struct {
+	conn      *sql.Conn
+	namespace int32
+	key       int32
+}
+
+// tryAdvisoryLock takes the lock without waiting, nil is returned when the lock is held by somebody else
+func (orm *Orm) tryAdvisoryLock(namespace, key int32) (*AdvisoryLock, error) {
+	conn, err := orm.DB.DB().Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	var locked bool
+	err = conn.QueryRowContext(context.Background(), "SELECT pg_try_advisory_lock($1, $2)", namespace, key).Scan(&locked)
+	if err != nil || !locked {
+		conn.Close()
+		return nil, err
+	}
+
+	return &AdvisoryLock{conn: conn, namespace: namespace, key: key}, nil
+}
+
+// Release unlocks and returns the connection to the pool
+func (l *AdvisoryLock) Release() {
+	_, err := l.conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1, $2)", l.namespace, l.key)
+	if err != nil {
+		logger.Error("pg_advisory_unlock:", err)
+	}
+
+	l.conn.Close()
+}
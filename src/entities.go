@@ -0,0 +1,122 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// entityMarkup returns markup MG shows for Telegram message entity,
+// entities not listed here (mentions, hashtags, plain URLs) are visible in text as is
+func entityMarkup(e tgbotapi.MessageEntity) (string, string) {
+	switch e.Type {
+	case "bold":
+		return "*", "*"
+	case "italic":
+		return "_", "_"
+	case "strikethrough":
+		return "~", "~"
+	case "code":
+		return "`", "`"
+	case "pre":
+		return "```\n", "\n```"
+	case "text_link":
+		return "", " (" + e.URL + ")"
+	case "text_mention":
+		if e.User != nil {
+			return "", " (tg://user?id=" + strconv.Itoa(e.User.ID) + ")"
+		}
+	}
+
+	return "", ""
+}
+
+// formatEntities converts Telegram message entities into text markup, so operator sees formatting and hidden links
+func formatEntities(text string, entities []tgbotapi.MessageEntity) string {
+	if len(entities) == 0 {
+		return text
+	}
+
+	type tag struct {
+		pos    int
+		length int
+		index  int
+		open   bool
+		markup string
+	}
+
+	var tags []tag
+	for i, e := range entities {
+		open, closing := entityMarkup(e)
+		if open == "" && closing == "" || e.Length <= 0 {
+			continue
+		}
+
+		tags = append(tags,
+			tag{pos: e.Offset, length: e.Length, index: i, open: true, markup: open},
+			tag{pos: e.Offset + e.Length, length: e.Length, index: i, markup: closing},
+		)
+	}
+
+	if len(tags) == 0 {
+		return text
+	}
+
+	// at the same position inner entities are closed first and outer entities are opened first
+	sort.SliceStable(tags, func(i, j int) bool {
+		a, b := tags[i], tags[j]
+		switch {
+		case a.pos != b.pos:
+			return a.pos < b.pos
+		case a.open != b.open:
+			return !a.open
+		case a.length != b.length:
+			return a.open == (a.length > b.length)
+		default:
+			return a.open == (a.index < b.index)
+		}
+	})
+
+	// entity offsets are measured in UTF-16 code units
+	units := utf16.Encode([]rune(text))
+
+	var (
+		sb   strings.Builder
+		last int
+	)
+
+	for _, t := range tags {
+		pos := t.pos
+		if pos > len(units) {
+			pos = len(units)
+		}
+
+		if pos > last {
+			sb.WriteString(string(utf16.Decode(units[last:pos])))
+			last = pos
+		}
+
+		sb.WriteString(t.markup)
+	}
+
+	sb.WriteString(string(utf16.Decode(units[last:])))
+
+	return sb.String()
+}
+
+// getMessageText returns text of the message with formatting
+func getMessageText(m *Message) string {
+	if m.Entities == nil {
+		return m.Text
+	}
+
+	return formatEntities(m.Text, *m.Entities)
+}
+
+// getCaptionText returns caption of the media message with formatting
+func getCaptionText(m *Message) string {
+	return formatEntities(m.Caption, m.CaptionEntities)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEntities_formatEntities(t *testing.T) {
+	assert.Equal(t, "plain", formatEntities("plain", nil))
+
+	assert.Equal(
+		t,
+		"*bold* and _italic_ see site (https://example.com)",
+		formatEntities("bold and italic see site", []tgbotapi.MessageEntity{
+			{Type: "bold", Offset: 0, Length: 4},
+			{Type: "italic", Offset: 9, Length: 6},
+			{Type: "text_link", Offset: 20, Length: 4, URL: "https://example.com"},
+		}),
+	)
+
+	// offsets are counted in UTF-16 code units, emoji takes two of them
+	assert.Equal(
+		t,
+		"🙂 *жирный* `code`",
+		formatEntities("🙂 жирный code", []tgbotapi.MessageEntity{
+			{Type: "bold", Offset: 3, Length: 6},
+			{Type: "code", Offset: 10, Length: 4},
+		}),
+	)
+
+	// nested and identical ranges
+	assert.Equal(
+		t,
+		"*_~all~_ bold*",
+		formatEntities("all bold", []tgbotapi.MessageEntity{
+			{Type: "bold", Offset: 0, Length: 8},
+			{Type: "italic", Offset: 0, Length: 3},
+			{Type: "strikethrough", Offset: 0, Length: 3},
+		}),
+	)
+
+	// entities visible in text are left as is
+	assert.Equal(
+		t,
+		"@user #tag John (tg://user?id=42)",
+		formatEntities("@user #tag John", []tgbotapi.MessageEntity{
+			{Type: "mention", Offset: 0, Length: 5},
+			{Type: "hashtag", Offset: 6, Length: 4},
+			{Type: "text_mention", Offset: 11, Length: 4, User: &tgbotapi.User{ID: 42}},
+		}),
+	)
+
+	assert.Equal(t, "```\nx := 1\n```", formatEntities("x := 1", []tgbotapi.MessageEntity{{Type: "pre", Offset: 0, Length: 6}}))
+	assert.Equal(t, "out of *range*", formatEntities("out of range", []tgbotapi.MessageEntity{{Type: "bold", Offset: 7, Length: 10}}))
+}
+
+func TestEntities_getCaptionText(t *testing.T) {
+	m := &Message{
+		Message:         tgbotapi.Message{Caption: "new price"},
+		CaptionEntities: []tgbotapi.MessageEntity{{Type: "bold", Offset: 4, Length: 5}},
+	}
+
+	assert.Equal(t, "new *price*", getCaptionText(m))
+}
@@ -79,8 +79,8 @@ func ErrorCaptureHandler(client *raven.Client, errorsStacktrace bool) ErrorHandl
 
 		b, ok := c.Get("bot")
 		if ok {
-			tags["bot"] = b.(Bot).Token
-			conn = *getConnectionById(b.(Bot).ConnectionID)
+			tags["bot"] = string(b.(Bot).Token)
+			conn = *getCachedConnectionByID(b.(Bot).ConnectionID)
 		}
 
 		if conn.APIURL != "" {
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf16"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	// ParseModeMarkdownV2 formats outbound messages with Telegram MarkdownV2
+	ParseModeMarkdownV2 = "MarkdownV2"
+	// ParseModeHTML formats outbound messages with Telegram HTML
+	ParseModeHTML = "HTML"
+)
+
+var (
+	markdownV2Replacer = strings.NewReplacer(
+		"\\", "\\\\", "_", "\\_", "*", "\\*", "[", "\\[", "]", "\\]", "(", "\\(", ")", "\\)",
+		"~", "\\~", "`", "\\`", ">", "\\>", "#", "\\#", "+", "\\+", "-", "\\-", "=", "\\=",
+		"|", "\\|", "{", "\\{", "}", "\\}", ".", "\\.", "!", "\\!",
+	)
+	htmlReplacer = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+)
+
+// Formatter renders text of outbound messages, all text passed to it is escaped
+type Formatter interface {
+	ParseMode() string
+	Escape(s string) string
+	Bold(s string) string
+	Italic(s string) string
+}
+
+type markdownFormatter struct{}
+
+func (markdownFormatter) ParseMode() string {
+	return ParseModeMarkdownV2
+}
+
+func (markdownFormatter) Escape(s string) string {
+	return markdownV2Replacer.Replace(s)
+}
+
+func (f markdownFormatter) Bold(s string) string {
+	return "*" + f.Escape(s) + "*"
+}
+
+func (f markdownFormatter) Italic(s string) string {
+	return "_" + f.Escape(s) + "_"
+}
+
+type htmlFormatter struct{}
+
+func (htmlFormatter) ParseMode() string {
+	return ParseModeHTML
+}
+
+func (htmlFormatter) Escape(s string) string {
+	return htmlReplacer.Replace(s)
+}
+
+func (f htmlFormatter) Bold(s string) string {
+	return "<b>" + f.Escape(s) + "</b>"
+}
+
+func (f htmlFormatter) Italic(s string) string {
+	return "<i>" + f.Escape(s) + "</i>"
+}
+
+// plainFormatter is used when Telegram can not parse formatted message
+type plainFormatter struct{}
+
+func (plainFormatter) ParseMode() string {
+	return ""
+}
+
+func (plainFormatter) Escape(s string) string {
+	return s
+}
+
+func (plainFormatter) Bold(s string) string {
+	return s
+}
+
+func (plainFormatter) Italic(s string) string {
+	return s
+}
+
+const (
+	styleBold   = "bold"
+	styleItalic = "italic"
+
+	// maxCaptionLength is Telegram limit for media captions
+	maxCaptionLength = 1024
+)
+
+// formattedText is message text built of segments, so it can be split into several messages
+// without breaking escape sequences and entities
+type formattedText struct {
+	f        Formatter
+	segments []textSegment
+}
+
+type textSegment struct {
+	text  string
+	style string
+}
+
+func newFormattedText(f Formatter) *formattedText {
+	return &formattedText{f: f}
+}
+
+// Text adds plain text
+func (t *formattedText) Text(s string) *formattedText {
+	return t.add(s, "")
+}
+
+// Bold adds bold text
+func (t *formattedText) Bold(s string) *formattedText {
+	return t.add(s, styleBold)
+}
+
+// Italic adds italic text
+func (t *formattedText) Italic(s string) *formattedText {
+	return t.add(s, styleItalic)
+}
+
+func (t *formattedText) add(s, style string) *formattedText {
+	if s != "" {
+		t.segments = append(t.segments, textSegment{s, style})
+	}
+
+	return t
+}
+
+func (t *formattedText) render(s textSegment) string {
+	switch s.style {
+	case styleBold:
+		return t.f.Bold(s.text)
+	case styleItalic:
+		return t.f.Italic(s.text)
+	default:
+		return t.f.Escape(s.text)
+	}
+}
+
+// String returns the whole text formatted
+func (t *formattedText) String() string {
+	var sb strings.Builder
+	for _, s := range t.segments {
+		sb.WriteString(t.render(s))
+	}
+
+	return sb.String()
+}
+
+// Split returns formatted parts, visible length of the first part is limited by first and of other parts by rest
+func (t *formattedText) Split(first, rest int) []string {
+	var (
+		parts  []string
+		sb     strings.Builder
+		length int
+	)
+
+	limit := first
+	flush := func() {
+		parts = append(parts, sb.String())
+		sb.Reset()
+		length = 0
+		limit = rest
+	}
+
+	for _, s := range t.segments {
+		text := s.text
+
+		for text != "" {
+			if n := textLength(text); length+n <= limit {
+				sb.WriteString(t.render(textSegment{text, s.style}))
+				length += n
+				break
+			}
+
+			head, tail := splitText(text, limit-length)
+			if head == "" {
+				if length == 0 {
+					head, tail = cutText(text, limit)
+				} else {
+					flush()
+					continue
+				}
+			}
+
+			sb.WriteString(t.render(textSegment{head, s.style}))
+			flush()
+			text = tail
+		}
+	}
+
+	if length > 0 || len(parts) == 0 {
+		parts = append(parts, sb.String())
+	}
+
+	return parts
+}
+
+// textLength returns length of text as Telegram counts it, in UTF-16 code units
+func textLength(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+// splitText splits text at the last line break or space fitting into limit, head is empty if there is none
+func splitText(s string, limit int) (string, string) {
+	head, _ := cutText(s, limit)
+
+	i := strings.LastIndex(head, "\n")
+	if i <= 0 {
+		i = strings.LastIndex(head, " ")
+	}
+
+	if i <= 0 {
+		return "", s
+	}
+
+	return s[:i+1], s[i+1:]
+}
+
+// cutText cuts text at rune boundary after limit UTF-16 code units
+func cutText(s string, limit int) (string, string) {
+	var n int
+	for i, r := range s {
+		n += len(utf16.Encode([]rune{r}))
+		if n > limit {
+			return s[:i], s[i:]
+		}
+	}
+
+	return s, ""
+}
+
+// getFormatter returns formatter for parse mode from config, MarkdownV2 is used by default
+func getFormatter() Formatter {
+	if config.ParseMode == ParseModeHTML {
+		return htmlFormatter{}
+	}
+
+	return markdownFormatter{}
+}
+
+// isEntityParseError returns true if Telegram rejected message because of broken formatting
+func isEntityParseError(err error) bool {
+	e, ok := err.(tgbotapi.Error)
+
+	return ok && strings.Contains(e.Message, "can't parse entities")
+}
+
+// sendWithFallback sends message, it is built again as plain text if Telegram can not parse its formatting
+func sendWithFallback(bot *tgbotapi.BotAPI, m tgbotapi.Chattable, plain func() (tgbotapi.Chattable, error)) ([]tgbotapi.Message, error) {
+	messages, err := sendChattable(bot, m)
+	if err == nil || !isEntityParseError(err) {
+		return messages, err
+	}
+
+	logger.Warningf("sendWithFallback: %s, sending as plain text", err.Error())
+
+	m, err = plain()
+	if err != nil {
+		return nil, err
+	}
+
+	return sendChattable(bot, m)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	v1 "github.com/retailcrm/mg-transport-api-client-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatter_markdownEscape(t *testing.T) {
+	f := markdownFormatter{}
+
+	cases := map[string]string{
+		"plain text":                     "plain text",
+		"Price: 1.5 (-10%)!":             "Price: 1\\.5 \\(\\-10%\\)\\!",
+		"snake_case *bold* `code`":       "snake\\_case \\*bold\\* \\`code\\`",
+		"[link](http://example.com?a=b)": "\\[link\\]\\(http://example\\.com?a\\=b\\)",
+		"a\\b":                           "a\\\\b",
+		"~strike~ > quote #tag +1 {x}|y": "\\~strike\\~ \\> quote \\#tag \\+1 \\{x\\}\\|y",
+		"<b>not html</b> & co":           "<b\\>not html</b\\> & co",
+		"эмодзи 🙂 и кириллица.":          "эмодзи 🙂 и кириллица\\.",
+	}
+
+	for in, out := range cases {
+		assert.Equal(t, out, f.Escape(in), in)
+	}
+
+	assert.Equal(t, "*Order \\#1\\.2*", f.Bold("Order #1.2"))
+	assert.Equal(t, "_x 10\\.5 $_", f.Italic("x 10.5 $"))
+}
+
+func TestFormatter_htmlEscape(t *testing.T) {
+	f := htmlFormatter{}
+
+	assert.Equal(t, "&lt;b&gt;x&lt;/b&gt; &amp;amp; *y* _z_", f.Escape("<b>x</b> &amp; *y* _z_"))
+	assert.Equal(t, "<b>A &amp; B</b>", f.Bold("A & B"))
+	assert.Equal(t, "<i>1 &lt; 2</i>", f.Italic("1 < 2"))
+}
+
+func TestFormatter_plain(t *testing.T) {
+	f := plainFormatter{}
+
+	assert.Equal(t, "", f.ParseMode())
+	assert.Equal(t, "*a_b*", f.Bold("*a_b*"))
+	assert.Equal(t, "<i>", f.Italic("<i>"))
+}
+
+func TestFormatter_isEntityParseError(t *testing.T) {
+	assert.True(t, isEntityParseError(tgbotapi.Error{
+		Message: "Bad Request: can't parse entities: Can't find end of the entity starting at byte offset 5",
+	}))
+	assert.False(t, isEntityParseError(tgbotapi.Error{Message: "Bad Request: chat not found"}))
+	assert.False(t, isEntityParseError(errors.New("can't parse entities")))
+}
+
+func TestFormatter_getOrderMessage(t *testing.T) {
+	setLocale("en")
+
+	order := &v1.MessageDataOrder{
+		Number: "C-1_2",
+		Items: []v1.MessageDataOrderItem{
+			{Name: "T-shirt (XL)", Quantity: &v1.MessageDataOrderQuantity{Value: 2.5}},
+		},
+		Delivery: &v1.MessageDataOrderDelivery{Name: "Courier", Address: "Main st. 1"},
+	}
+
+	assert.Equal(
+		t,
+		"*Order C\\-1\\_2*\n\n1\\. T\\-shirt \\(XL\\) _2\\.5_\n\n*Delivery:*\nCourier;\nMain st\\. 1\n",
+		getOrderMessage(markdownFormatter{}, order).String(),
+	)
+	assert.Equal(
+		t,
+		"<b>Order C-1_2</b>\n\n1. T-shirt (XL) <i>2.5</i>\n\n<b>Delivery:</b>\nCourier;\nMain st. 1\n",
+		getOrderMessage(htmlFormatter{}, order).String(),
+	)
+	assert.Equal(
+		t,
+		"Order C-1_2\n\n1. T-shirt (XL) 2.5\n\nDelivery:\nCourier;\nMain st. 1\n",
+		getOrderMessage(plainFormatter{}, order).String(),
+	)
+}
+
+func TestFormatter_Split(t *testing.T) {
+	text := newFormattedText(markdownFormatter{}).Bold("Title.").Text("\nfirst line.\nsecond line")
+	assert.Equal(t, []string{"*Title\\.*\nfirst line\\.\nsecond line"}, text.Split(100, 100))
+
+	// split at line break, escape sequences are never broken
+	assert.Equal(t, []string{"*Title\\.*\nfirst line\\.\n", "second line"}, text.Split(20, 20))
+
+	// split at space when the line is too long, entities are closed and reopened
+	long := newFormattedText(markdownFormatter{}).Bold("very long bold title")
+	assert.Equal(t, []string{"*very long *", "*bold title*"}, long.Split(10, 10))
+
+	// words longer than limit are cut
+	assert.Equal(t, []string{"abcd", "efgh", "ij"}, newFormattedText(plainFormatter{}).Text("abcdefghij").Split(4, 4))
+
+	// first part may have different limit, e.g. media caption
+	assert.Equal(t, []string{"aa ", "bb cc dd"}, newFormattedText(plainFormatter{}).Text("aa bb cc dd").Split(4, 10))
+
+	// length is counted in UTF-16 code units
+	assert.Equal(t, []string{"🙂🙂", "🙂"}, newFormattedText(plainFormatter{}).Text("🙂🙂🙂").Split(4, 4))
+
+	assert.Equal(t, []string{""}, newFormattedText(htmlFormatter{}).Split(10, 10))
+}
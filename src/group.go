@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	v1 "github.com/retailcrm/mg-transport-api-client-go/v1"
+)
+
+const (
+	// GroupModeAll bot forwards every message of group chats
+	GroupModeAll = "all"
+	// GroupModeMention bot forwards only group messages mentioning it or replying to it
+	GroupModeMention = "mention"
+	// GroupModeDisabled bot ignores group chats
+	GroupModeDisabled = "disabled"
+
+	// topicSeparator separates chat ID and forum topic ID in MG chat ID
+	topicSeparator = ":"
+)
+
+type groupModeOption struct {
+	Value string
+	Label string
+}
+
+func isValidGroupMode(mode string) bool {
+	return mode == "" || mode == GroupModeAll || mode == GroupModeMention || mode == GroupModeDisabled
+}
+
+func getGroupModeOptions() []groupModeOption {
+	return []groupModeOption{
+		{GroupModeAll, getLocalizedMessage("group_mode_all")},
+		{GroupModeMention, getLocalizedMessage("group_mode_mention")},
+		{GroupModeDisabled, getLocalizedMessage("group_mode_disabled")},
+	}
+}
+
+// getGroupMode returns how bot handles group chats, groups were always accepted before the setting appeared
+func (b *Bot) getGroupMode() string {
+	if b.GroupMode != "" {
+		return b.GroupMode
+	}
+
+	return GroupModeAll
+}
+
+// acceptsMessage returns true if message should be forwarded to MG according to group mode of the bot
+func (b *Bot) acceptsMessage(m *Message) bool {
+	if m.Chat == nil || m.Chat.IsPrivate() {
+		return true
+	}
+
+	switch b.getGroupMode() {
+	case GroupModeDisabled:
+		return false
+	case GroupModeMention:
+		return isBotMentioned(b.Name, m)
+	default:
+		return true
+	}
+}
+
+func isBotMentioned(name string, m *Message) bool {
+	if name == "" {
+		return false
+	}
+
+	if m.ReplyToMessage != nil && !m.isReplyToTopic() &&
+		m.ReplyToMessage.From != nil && strings.EqualFold(m.ReplyToMessage.From.UserName, name) {
+		return true
+	}
+
+	text := m.Text
+	if text == "" {
+		text = m.Caption
+	}
+
+	return strings.Contains(strings.ToLower(text), "@"+strings.ToLower(name))
+}
+
+// getExternalChatID returns MG chat ID of the message, every forum topic is a separate chat
+func getExternalChatID(m *Message) string {
+	if m.IsTopicMessage && m.MessageThreadID != 0 {
+		return fmt.Sprintf("%d%s%d", m.Chat.ID, topicSeparator, m.MessageThreadID)
+	}
+
+	return strconv.FormatInt(m.Chat.ID, 10)
+}
+
+// parseExternalChatID returns Telegram chat ID and forum topic ID of MG chat
+func parseExternalChatID(externalChatID string) (int64, int) {
+	parts := strings.SplitN(externalChatID, topicSeparator, 2)
+	cid, _ := strconv.ParseInt(parts[0], 10, 64)
+
+	if len(parts) < 2 {
+		return cid, 0
+	}
+
+	threadID, _ := strconv.Atoi(parts[1])
+
+	return cid, threadID
+}
+
+// threadMessage is a message sent to the forum topic, the bundled Bot API client has no message_thread_id
+// so the request is built by sendThreadMessage
+type threadMessage struct {
+	tgbotapi.Chattable
+	ThreadID int
+}
+
+// setMessageThread sends message to the forum topic
+func setMessageThread(m tgbotapi.Chattable, threadID int) tgbotapi.Chattable {
+	m, _ = unwrapThread(m)
+	if threadID == 0 {
+		return m
+	}
+
+	return threadMessage{Chattable: m, ThreadID: threadID}
+}
+
+// unwrapThread returns message and ID of the forum topic it is sent to
+func unwrapThread(m tgbotapi.Chattable) (tgbotapi.Chattable, int) {
+	if t, ok := m.(threadMessage); ok {
+		return t.Chattable, t.ThreadID
+	}
+
+	return m, 0
+}
+
+// sendThreadMessage sends message to the forum topic with parameters the bundled client would send and message_thread_id
+func sendThreadMessage(bot *tgbotapi.BotAPI, m tgbotapi.Chattable, threadID int) (tgbotapi.Message, error) {
+	var (
+		method, field string
+		file          tgbotapi.BaseFile
+		params        = map[string]string{"message_thread_id": strconv.Itoa(threadID)}
+	)
+
+	setCaption := func(caption, parseMode string) {
+		if caption != "" {
+			params["caption"] = caption
+			if parseMode != "" {
+				params["parse_mode"] = parseMode
+			}
+		}
+	}
+
+	setDuration := func(duration int) {
+		if duration != 0 {
+			params["duration"] = strconv.Itoa(duration)
+		}
+	}
+
+	switch msg := m.(type) {
+	case tgbotapi.MessageConfig:
+		if err := setBaseChatParams(params, msg.BaseChat); err != nil {
+			return tgbotapi.Message{}, err
+		}
+
+		params["text"] = msg.Text
+		if msg.ParseMode != "" {
+			params["parse_mode"] = msg.ParseMode
+		}
+
+		if msg.DisableWebPagePreview {
+			params["disable_web_page_preview"] = "true"
+		}
+
+		return sendMessageRequest(bot, "sendMessage", params)
+	case tgbotapi.PhotoConfig:
+		method, field, file = "sendPhoto", "photo", msg.BaseFile
+		setCaption(msg.Caption, msg.ParseMode)
+	case tgbotapi.DocumentConfig:
+		method, field, file = "sendDocument", "document", msg.BaseFile
+		setCaption(msg.Caption, msg.ParseMode)
+	case tgbotapi.VideoConfig:
+		method, field, file = "sendVideo", "video", msg.BaseFile
+		setCaption(msg.Caption, msg.ParseMode)
+		setDuration(msg.Duration)
+	case tgbotapi.AudioConfig:
+		method, field, file = "sendAudio", "audio", msg.BaseFile
+		setCaption(msg.Caption, msg.ParseMode)
+		setDuration(msg.Duration)
+		if msg.Performer != "" {
+			params["performer"] = msg.Performer
+		}
+
+		if msg.Title != "" {
+			params["title"] = msg.Title
+		}
+	case tgbotapi.VoiceConfig:
+		method, field, file = "sendVoice", "voice", msg.BaseFile
+		setCaption(msg.Caption, msg.ParseMode)
+		setDuration(msg.Duration)
+	default:
+		return bot.Send(m)
+	}
+
+	if err := setBaseChatParams(params, file.BaseChat); err != nil {
+		return tgbotapi.Message{}, err
+	}
+
+	if file.UseExisting {
+		params[field] = file.FileID
+		return sendMessageRequest(bot, method, params)
+	}
+
+	if file.MimeType != "" {
+		params["mime_type"] = file.MimeType
+	}
+
+	resp, err := bot.UploadFile(method, params, field, file.File)
+	if err != nil {
+		return tgbotapi.Message{}, err
+	}
+
+	var message tgbotapi.Message
+	err = json.Unmarshal(resp.Result, &message)
+
+	return message, err
+}
+
+func setBaseChatParams(params map[string]string, chat tgbotapi.BaseChat) error {
+	params["chat_id"] = strconv.FormatInt(chat.ChatID, 10)
+
+	if chat.ReplyToMessageID != 0 {
+		params["reply_to_message_id"] = strconv.Itoa(chat.ReplyToMessageID)
+	}
+
+	if chat.ReplyMarkup != nil {
+		data, err := json.Marshal(chat.ReplyMarkup)
+		if err != nil {
+			return err
+		}
+
+		params["reply_markup"] = string(data)
+	}
+
+	if chat.DisableNotification {
+		params["disable_notification"] = "true"
+	}
+
+	return nil
+}
+
+func sendMessageRequest(bot *tgbotapi.BotAPI, method string, params map[string]string) (tgbotapi.Message, error) {
+	v := url.Values{}
+	for key, value := range params {
+		v.Set(key, value)
+	}
+
+	resp, err := bot.MakeRequest(method, v)
+	if err != nil {
+		return tgbotapi.Message{}, err
+	}
+
+	var message tgbotapi.Message
+	err = json.Unmarshal(resp.Result, &message)
+
+	return message, err
+}
+
+// getSenderChatCustomer returns customer for messages sent on behalf of a chat, e.g. by anonymous group admins
+func getSenderChatCustomer(chat *tgbotapi.Chat) v1.Customer {
+	nickname := chat.UserName
+	if nickname == "" {
+		nickname = chat.Title
+	}
+
+	return v1.Customer{
+		ExternalID: strconv.FormatInt(chat.ID, 10),
+		Nickname:   nickname,
+		Firstname:  chat.Title,
+	}
+}
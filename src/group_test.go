@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/h2non/gock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroup_acceptsMessage(t *testing.T) {
+	private := &Message{Message: tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 1, Type: "private"}, Text: "hello"}}
+	group := &Message{Message: tgbotapi.Message{Chat: &tgbotapi.Chat{ID: -1, Type: "supergroup"}, Text: "hello"}}
+	mention := &Message{Message: tgbotapi.Message{Chat: &tgbotapi.Chat{ID: -1, Type: "supergroup"}, Text: "hello @Shop_Bot"}}
+	reply := &Message{Message: tgbotapi.Message{
+		Chat:           &tgbotapi.Chat{ID: -1, Type: "group"},
+		Text:           "hello",
+		ReplyToMessage: &tgbotapi.Message{MessageID: 5, From: &tgbotapi.User{UserName: "shop_bot"}},
+	}}
+
+	b := Bot{Name: "shop_bot"}
+	assert.True(t, b.acceptsMessage(group))
+
+	b.GroupMode = GroupModeDisabled
+	assert.True(t, b.acceptsMessage(private))
+	assert.False(t, b.acceptsMessage(group))
+
+	b.GroupMode = GroupModeMention
+	assert.False(t, b.acceptsMessage(group))
+	assert.True(t, b.acceptsMessage(mention))
+	assert.True(t, b.acceptsMessage(reply))
+
+	reply.IsTopicMessage = true
+	reply.MessageThreadID = 5
+	assert.False(t, b.acceptsMessage(reply))
+}
+
+func TestGroup_externalChatID(t *testing.T) {
+	m := &Message{Message: tgbotapi.Message{Chat: &tgbotapi.Chat{ID: -100123}}}
+	assert.Equal(t, "-100123", getExternalChatID(m))
+
+	m.IsTopicMessage = true
+	m.MessageThreadID = 42
+	assert.Equal(t, "-100123:42", getExternalChatID(m))
+
+	cid, threadID := parseExternalChatID("-100123:42")
+	assert.Equal(t, int64(-100123), cid)
+	assert.Equal(t, 42, threadID)
+
+	cid, threadID = parseExternalChatID("123")
+	assert.Equal(t, int64(123), cid)
+	assert.Equal(t, 0, threadID)
+
+	msg := setMessageThread(tgbotapi.NewMessage(cid, "text"), 42)
+	sent, threadID := unwrapThread(msg)
+	assert.Equal(t, 42, threadID)
+	assert.Equal(t, 0, sent.(tgbotapi.MessageConfig).ReplyToMessageID)
+	assert.Equal(t, 1, chattableSize(msg))
+
+	sent, threadID = unwrapThread(setMessageThread(msg, 0))
+	assert.Equal(t, 0, threadID)
+	assert.IsType(t, tgbotapi.MessageConfig{}, sent)
+}
+
+func TestGroup_sendThreadMessage(t *testing.T) {
+	defer gock.Off()
+
+	gock.New("https://api.telegram.org").
+		Post("/bot123123:Qwerty/sendMessage").
+		MatchType("url").
+		BodyString(`chat_id=-100123&message_thread_id=42&parse_mode=HTML&text=hello`).
+		Reply(200).
+		BodyString(`{"ok":true,"result":{"message_id":10,"chat":{"id":-100123}}}`)
+	gock.New("https://api.telegram.org").
+		Post("/bot123123:Qwerty/sendPhoto").
+		MatchType("url").
+		BodyString(`caption=photo&chat_id=-100123&message_thread_id=42&photo=file-id`).
+		Reply(200).
+		BodyString(`{"ok":true,"result":{"message_id":11,"chat":{"id":-100123}}}`)
+	gock.New("https://api.telegram.org").
+		Post("/bot123123:Qwerty/sendDocument").
+		BodyString(`name="message_thread_id"\s+42`).
+		Reply(200).
+		BodyString(`{"ok":true,"result":{"message_id":12,"chat":{"id":-100123}}}`)
+
+	bot := &tgbotapi.BotAPI{Token: "123123:Qwerty", Client: &http.Client{}}
+
+	text := tgbotapi.NewMessage(-100123, "hello")
+	text.ParseMode = "HTML"
+	messages, err := sendChattable(bot, setMessageThread(text, 42))
+	if assert.NoError(t, err) && assert.Len(t, messages, 1) {
+		assert.Equal(t, 10, messages[0].MessageID)
+	}
+
+	photo := tgbotapi.NewPhotoShare(-100123, "file-id")
+	photo.Caption = "photo"
+	messages, err = sendChattable(bot, setMessageThread(photo, 42))
+	if assert.NoError(t, err) && assert.Len(t, messages, 1) {
+		assert.Equal(t, 11, messages[0].MessageID)
+	}
+
+	document := tgbotapi.NewDocumentUpload(-100123, tgbotapi.FileBytes{Name: "file.txt", Bytes: []byte("text")})
+	messages, err = sendChattable(bot, setMessageThread(document, 42))
+	if assert.NoError(t, err) && assert.Len(t, messages, 1) {
+		assert.Equal(t, 12, messages[0].MessageID)
+	}
+
+	assert.True(t, gock.IsDone())
+}
@@ -61,6 +61,8 @@ func getLocale() map[string]interface{} {
 		"TableDelete": getLocalizedMessage("table_delete"),
 		"Title":       getLocalizedMessage("title"),
 		"Language":    getLocalizedMessage("language"),
+		"GroupMode":   getLocalizedMessage("group_mode"),
+		"UpdateMode":  getLocalizedMessage("update_mode"),
 		"InfoBot":     template.HTML(getLocalizedMessage("info_bot")),
 		"CRMLink":     template.HTML(getLocalizedMessage("crm_link")),
 		"DocLink":     template.HTML(getLocalizedMessage("doc_link")),
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	v1 "github.com/retailcrm/mg-transport-api-client-go/v1"
+)
+
+const (
+	// MessageDirectionIn marks messages received from customer
+	MessageDirectionIn = "in"
+	// MessageDirectionOut marks messages sent by operator
+	MessageDirectionOut = "out"
+)
+
+// isNotModifiedError returns true if edited message already has the same content
+func isNotModifiedError(err error) bool {
+	e, ok := err.(tgbotapi.Error)
+
+	return ok && strings.Contains(e.Message, "message is not modified")
+}
+
+// isNoTextError returns true if edited message is media and has only caption
+func isNoTextError(err error) bool {
+	e, ok := err.(tgbotapi.Error)
+
+	return ok && strings.Contains(e.Message, "there is no text in the message to edit")
+}
+
+// sendChattable sends message to Telegram, media group is sent as several messages
+func sendChattable(bot *tgbotapi.BotAPI, m tgbotapi.Chattable) ([]tgbotapi.Message, error) {
+	m, threadID := unwrapThread(m)
+	if group, ok := m.(tgbotapi.MediaGroupConfig); ok {
+		return sendMediaGroup(bot, group, threadID)
+	}
+
+	var (
+		msg tgbotapi.Message
+		err error
+	)
+
+	if threadID != 0 {
+		msg, err = sendThreadMessage(bot, m, threadID)
+	} else {
+		msg, err = bot.Send(m)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return []tgbotapi.Message{msg}, nil
+}
+
+// sendMediaGroup sends album, the bundled Bot API client can not decode the list of messages Telegram returns for it
+func sendMediaGroup(bot *tgbotapi.BotAPI, group tgbotapi.MediaGroupConfig, threadID int) ([]tgbotapi.Message, error) {
+	media, err := json.Marshal(group.InputMedia)
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	params.Set("chat_id", strconv.FormatInt(group.ChatID, 10))
+	params.Set("media", string(media))
+
+	if group.ReplyToMessageID != 0 {
+		params.Set("reply_to_message_id", strconv.Itoa(group.ReplyToMessageID))
+	}
+
+	if group.DisableNotification {
+		params.Set("disable_notification", "true")
+	}
+
+	if threadID != 0 {
+		params.Set("message_thread_id", strconv.Itoa(threadID))
+	}
+
+	resp, err := bot.MakeRequest("sendMediaGroup", params)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []tgbotapi.Message
+	err = json.Unmarshal(resp.Result, &messages)
+
+	return messages, err
+}
+
+// chattableSize returns the number of Telegram messages the message is sent as
+func chattableSize(m tgbotapi.Chattable) int {
+	m, _ = unwrapThread(m)
+	if group, ok := m.(tgbotapi.MediaGroupConfig); ok {
+		return len(group.InputMedia)
+	}
+
+	return 1
+}
+
+const (
+	// MessageKindText marks Telegram message sent as plain text, other kinds are named after the media they carry
+	MessageKindText = "text"
+	// MessageKindMedia marks sent media of unknown type, it was mapped before kinds were stored and only its caption is edited
+	MessageKindMedia = "media"
+)
+
+// getMessageKind returns kind of the sent Telegram message, it decides whether the message is edited as text or caption
+func getMessageKind(msg tgbotapi.Message) string {
+	if msg.Text != "" {
+		return MessageKindText
+	}
+
+	return getMessageID(&Message{Message: msg})
+}
+
+// getItemIDs returns IDs of MG files, N-th file is sent as N-th Telegram message
+func getItemIDs(data WebhookData) []string {
+	if data.Items == nil {
+		return nil
+	}
+
+	ids := make([]string, 0, len(*data.Items))
+	for _, item := range *data.Items {
+		ids = append(ids, item.ID)
+	}
+
+	return ids
+}
+
+// saveSentMessages maps Telegram messages MG message was sent as, numbering them from the given part,
+// fileIDs hold MG files of the whole message by part
+func saveSentMessages(b *Bot, cid int64, externalID string, firstPart int, messages []tgbotapi.Message, fileIDs []string) error {
+	for i, msg := range messages {
+		m := MessageMap{
+			BotID:      b.ID,
+			ChatID:     cid,
+			MessageID:  msg.MessageID,
+			ExternalID: externalID,
+			Part:       firstPart + i,
+			Direction:  MessageDirectionOut,
+			Kind:       getMessageKind(msg),
+		}
+
+		if m.Kind != MessageKindText && m.Part < len(fileIDs) {
+			m.FileID = fileIDs[m.Part]
+		}
+
+		if err := m.save(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getSentMessages returns Telegram messages MG message was sent as,
+// messages sent before the mapping appeared are resolved by external ID
+func getSentMessages(b *Bot, cid int64, externalID string) []MessageMap {
+	maps := getMessageMaps(b.ID, cid, externalID)
+	if len(maps) > 0 {
+		return maps
+	}
+
+	if uid := getTelegramMessageID(externalID); uid != 0 {
+		return []MessageMap{{BotID: b.ID, ChatID: cid, MessageID: uid, ExternalID: externalID, Direction: MessageDirectionOut}}
+	}
+
+	return nil
+}
+
+// getQuotedMessageID returns Telegram ID of the message MG message quotes
+func getQuotedMessageID(b *Bot, cid int64, externalID string) int {
+	if externalID == "" {
+		return 0
+	}
+
+	if maps := getSentMessages(b, cid, externalID); len(maps) > 0 {
+		return maps[0].MessageID
+	}
+
+	return 0
+}
+
+// getQuoteExternalID returns MG external ID of Telegram message customer replied to
+func getQuoteExternalID(b *Bot, cid int64, messageID int) string {
+	if m := getMessageMapByMessageID(b.ID, cid, messageID); m.ID != 0 {
+		return m.ExternalID
+	}
+
+	return strconv.Itoa(messageID)
+}
+
+// editSentMessages updates every part of the message: text is replaced, media get new caption or,
+// when MG message has another file, new media, redundant parts are deleted and missing ones are sent.
+// Text is formatted the same way it was sent and is edited again as plain text if Telegram can not parse it
+func editSentMessages(bot *tgbotapi.BotAPI, b *Bot, mgClient *v1.MgClient, data WebhookData) error {
+	err := editSentParts(bot, b, mgClient, data, getFormatter())
+	if isEntityParseError(err) {
+		return editSentParts(bot, b, mgClient, data, plainFormatter{})
+	}
+
+	return err
+}
+
+func editSentParts(bot *tgbotapi.BotAPI, b *Bot, mgClient *v1.MgClient, data WebhookData, f Formatter) error {
+	cid, threadID := parseExternalChatID(data.ExternalChatID)
+	externalID := data.ExternalMessageID
+	maps := getSentMessages(b, cid, externalID)
+	for _, m := range maps {
+		// keep message sent before the mapping appeared in case it gets more parts
+		if m.ID == 0 {
+			if err := m.save(); err != nil {
+				return err
+			}
+		}
+	}
+
+	media := 0
+	for media < len(maps) && maps[media].Kind != "" && maps[media].Kind != MessageKindText {
+		media++
+	}
+
+	var (
+		texts     []string
+		parseMode string
+	)
+	if media > 0 {
+		captions := newFormattedText(plainFormatter{}).Text(data.Content).Split(maxCaptionLength, int(MaxCharsCount))
+
+		var items []v1.FileItem
+		if data.Items != nil {
+			items = *data.Items
+		}
+
+		for i, m := range maps[:media] {
+			var item *v1.FileItem
+			if i < len(items) && items[i].ID != m.FileID {
+				item = &items[i]
+			}
+
+			// every album item is sent with the caption, so it is edited on all of them
+			if err := editSentMedia(bot, mgClient, m, item, captions[0]); err != nil {
+				return err
+			}
+		}
+
+		// captions are sent as plain text, so is their rest
+		texts = captions[1:]
+	} else {
+		texts = newFormattedText(f).Text(data.Content).Split(int(MaxCharsCount), int(MaxCharsCount))
+		parseMode = f.ParseMode()
+	}
+
+	// the rest of the caption and text go after media
+	parts := maps[media:]
+	for i, text := range texts {
+		if i < len(parts) {
+			edit := tgbotapi.NewEditMessageText(cid, parts[i].MessageID, text)
+			edit.ParseMode = parseMode
+
+			_, err := bot.Send(edit)
+			if isNoTextError(err) && parts[i].Kind == "" {
+				// message mapped before kinds were stored turned out to be media
+				parts[i].Kind = MessageKindMedia
+				if err := parts[i].save(); err != nil {
+					return err
+				}
+
+				return editSentParts(bot, b, mgClient, data, f)
+			}
+
+			if err != nil && !isNotModifiedError(err) {
+				return err
+			}
+
+			continue
+		}
+
+		message := tgbotapi.NewMessage(cid, text)
+		message.ParseMode = parseMode
+
+		msgSend, err := sendChattable(bot, setMessageThread(message, threadID))
+		if err != nil {
+			return err
+		}
+
+		if err := saveSentMessages(b, cid, externalID, media+i, msgSend, nil); err != nil {
+			return err
+		}
+	}
+
+	if len(parts) > len(texts) {
+		for _, m := range parts[len(texts):] {
+			if _, err := bot.Send(tgbotapi.NewDeleteMessage(cid, m.MessageID)); err != nil {
+				logger.Errorf("editSentMessages delete part %d of %s: %s", m.Part, externalID, err.Error())
+			}
+		}
+
+		return deleteMessageMaps(b.ID, cid, externalID, media+len(texts))
+	}
+
+	return nil
+}
+
+// editSentMedia sets caption of the sent media or replaces media with the given MG file,
+// voice messages and stickers can not be replaced so only their caption is edited
+func editSentMedia(bot *tgbotapi.BotAPI, mgClient *v1.MgClient, m MessageMap, item *v1.FileItem, caption string) error {
+	if item == nil || !isEditableMediaKind(m.Kind) {
+		_, err := bot.Send(tgbotapi.NewEditMessageCaption(m.ChatID, m.MessageID, caption))
+		if err != nil && !isNotModifiedError(err) {
+			return err
+		}
+
+		return nil
+	}
+
+	file, _, err := mgClient.GetFile(item.ID)
+	if err != nil {
+		return err
+	}
+
+	media := map[string]string{"type": m.Kind, "caption": caption}
+	params := map[string]string{
+		"chat_id":    strconv.FormatInt(m.ChatID, 10),
+		"message_id": strconv.Itoa(m.MessageID),
+	}
+
+	if m.Kind == "photo" {
+		if err := checkFileSize(int64(item.Size), telegramPhotoURLLimit); err != nil {
+			return err
+		}
+
+		// Telegram downloads photos by itself, same as when they are sent
+		media["media"] = file.Url
+		encoded, err := json.Marshal(media)
+		if err != nil {
+			return err
+		}
+
+		values := url.Values{}
+		for k, v := range params {
+			values.Set(k, v)
+		}
+		values.Set("media", string(encoded))
+
+		if _, err := bot.MakeRequest("editMessageMedia", values); err != nil && !isNotModifiedError(err) {
+			return err
+		}
+	} else {
+		if err := checkFileSize(int64(item.Size), telegramUploadLimit); err != nil {
+			return err
+		}
+
+		media["media"] = "attach://file"
+		encoded, err := json.Marshal(media)
+		if err != nil {
+			return err
+		}
+		params["media"] = string(encoded)
+
+		reader := getFileReader(item.Caption, file.Url, int64(item.Size))
+		if _, err := bot.UploadFile("editMessageMedia", params, "file", reader); err != nil && !isNotModifiedError(err) {
+			return err
+		}
+	}
+
+	m.FileID = item.ID
+
+	return m.save()
+}
+
+// isEditableMediaKind returns true if Telegram allows to replace media of the message of the given kind
+func isEditableMediaKind(kind string) bool {
+	switch kind {
+	case "photo", "video", "audio", "document", "animation":
+		return true
+	default:
+		return false
+	}
+}
+
+// deleteSentMessages deletes every Telegram message MG message was sent as
+func deleteSentMessages(bot *tgbotapi.BotAPI, b *Bot, cid int64, externalID string) error {
+	for _, m := range getSentMessages(b, cid, externalID) {
+		if _, err := bot.Send(tgbotapi.NewDeleteMessage(cid, m.MessageID)); err != nil {
+			return err
+		}
+	}
+
+	return deleteMessageMaps(b.ID, cid, externalID, 0)
+}
+
+// markOperatorMessagesRead reports operator messages preceding the customer message as read,
+// Telegram does not tell bots about read messages so the customer reply is the only evidence.
+// MG is asked only once for the last operator message, retries of the customer message skip it
+func markOperatorMessagesRead(client *v1.MgClient, b *Bot, cid int64) {
+	last := getLastMessageMap(b.ID, cid)
+	if last.ID == 0 || last.Direction != MessageDirectionOut || last.Read {
+		return
+	}
+
+	_, st, err := client.MarkMessageRead(v1.MarkMessageReadRequest{
+		Message:   v1.MarkMessageReadRequestMessage{ExternalID: last.ExternalID},
+		ChannelID: b.Channel,
+	})
+	if err != nil {
+		logger.Errorf("markOperatorMessagesRead bot %d chat %d: status %d: %s", b.ID, cid, st, err.Error())
+		return
+	}
+
+	if err := last.setRead(); err != nil {
+		logger.Errorf("markOperatorMessagesRead bot %d chat %d: %s", b.ID, cid, err.Error())
+	}
+}
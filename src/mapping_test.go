@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/h2non/gock"
+	v1 "github.com/retailcrm/mg-transport-api-client-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMapping_sendMediaGroup(t *testing.T) {
+	defer gock.Off()
+
+	gock.New("https://api.telegram.org").
+		Post("/bot123123:Qwerty/sendMediaGroup").
+		MatchType("url").
+		BodyString(`chat_id=123&media=.+&reply_to_message_id=7`).
+		Reply(200).
+		BodyString(`{"ok":true,"result":[{"message_id":10,"chat":{"id":123}},{"message_id":11,"chat":{"id":123}}]}`)
+
+	bot := &tgbotapi.BotAPI{Token: "123123:Qwerty", Client: &http.Client{}}
+	group := tgbotapi.NewMediaGroup(123, []interface{}{
+		tgbotapi.NewInputMediaPhoto("https://example.com/1.jpg"),
+		tgbotapi.NewInputMediaPhoto("https://example.com/2.jpg"),
+	})
+	group.ReplyToMessageID = 7
+
+	assert.Equal(t, 2, chattableSize(group))
+	assert.Equal(t, 1, chattableSize(tgbotapi.NewMessage(123, "text")))
+
+	messages, err := sendChattable(bot, group)
+	if assert.NoError(t, err) && assert.Len(t, messages, 2) {
+		assert.Equal(t, 10, messages[0].MessageID)
+		assert.Equal(t, 11, messages[1].MessageID)
+	}
+}
+
+func TestMapping_getMessageKind(t *testing.T) {
+	assert.Equal(t, MessageKindText, getMessageKind(tgbotapi.Message{Text: "text"}))
+	assert.Equal(t, "photo", getMessageKind(tgbotapi.Message{Photo: &[]tgbotapi.PhotoSize{{FileID: "1"}}}))
+	assert.Equal(t, "document", getMessageKind(tgbotapi.Message{Document: &tgbotapi.Document{FileID: "1"}, Caption: "file"}))
+
+	assert.True(t, isEditableMediaKind("photo"))
+	assert.False(t, isEditableMediaKind("voice"))
+	assert.False(t, isEditableMediaKind(MessageKindText))
+}
+
+func newMappingBot() *Bot {
+	return &Bot{Channel: 9000003, Token: "9000003:Mapping"}
+}
+
+func editWebhookData(content string) WebhookData {
+	return WebhookData{WebhookData: v1.WebhookData{ExternalChatID: "123", ExternalMessageID: "50", Content: content}}
+}
+
+func TestMapping_editSentMessages_Formatted(t *testing.T) {
+	defer gock.Off()
+
+	b := newMappingBot()
+	bot := createTestBot(t, b)
+	defer deleteTestBot(b)
+	defer deleteMessageMaps(b.ID, 123, "50", 0)
+
+	m := MessageMap{BotID: b.ID, ChatID: 123, MessageID: 50, ExternalID: "50", Direction: MessageDirectionOut, Kind: MessageKindText}
+	require.NoError(t, m.save())
+
+	gock.New("https://api.telegram.org").
+		Post("/bot9000003:Mapping/editMessageText").
+		MatchType("url").
+		BodyString(`chat_id=123&disable_web_page_preview=false&message_id=50&parse_mode=MarkdownV2&text=a%5C.b`).
+		Reply(200).
+		BodyString(`{"ok":true,"result":{"message_id":50,"chat":{"id":123},"text":"a.b"}}`)
+
+	require.NoError(t, editSentMessages(bot, b, nil, editWebhookData("a.b")))
+	assert.True(t, gock.IsDone())
+}
+
+func TestMapping_editSentMessages_UnknownKind(t *testing.T) {
+	defer gock.Off()
+
+	b := newMappingBot()
+	bot := createTestBot(t, b)
+	defer deleteTestBot(b)
+	defer deleteMessageMaps(b.ID, 123, "50", 0)
+
+	// message sent before kinds were stored
+	m := MessageMap{BotID: b.ID, ChatID: 123, MessageID: 50, ExternalID: "50", Direction: MessageDirectionOut}
+	require.NoError(t, m.save())
+
+	gock.New("https://api.telegram.org").
+		Post("/bot9000003:Mapping/editMessageText").
+		Reply(400).
+		BodyString(`{"ok":false,"error_code":400,"description":"Bad Request: there is no text in the message to edit"}`)
+	gock.New("https://api.telegram.org").
+		Post("/bot9000003:Mapping/editMessageCaption").
+		MatchType("url").
+		BodyString(`caption=new\+caption&chat_id=123&message_id=50`).
+		Reply(200).
+		BodyString(`{"ok":true,"result":{"message_id":50,"chat":{"id":123},"caption":"new caption"}}`)
+
+	require.NoError(t, editSentMessages(bot, b, nil, editWebhookData("new caption")))
+	assert.True(t, gock.IsDone())
+
+	maps := getMessageMaps(b.ID, 123, "50")
+	if assert.Len(t, maps, 1) {
+		assert.Equal(t, MessageKindMedia, maps[0].Kind)
+	}
+}
+
+func TestMapping_editSentMessages_Album(t *testing.T) {
+	defer gock.Off()
+
+	b := newMappingBot()
+	bot := createTestBot(t, b)
+	defer deleteTestBot(b)
+	defer deleteMessageMaps(b.ID, 123, "50", 0)
+
+	items := []v1.FileItem{{ID: "file-1"}, {ID: "file-2"}, {ID: "file-3"}}
+	for i, item := range items {
+		m := MessageMap{
+			BotID: b.ID, ChatID: 123, MessageID: 50 + i, ExternalID: "50", Part: i,
+			Direction: MessageDirectionOut, Kind: "photo", FileID: item.ID,
+		}
+		require.NoError(t, m.save())
+
+		gock.New("https://api.telegram.org").
+			Post("/bot9000003:Mapping/editMessageCaption").
+			MatchType("url").
+			BodyString(fmt.Sprintf(`caption=new\+caption&chat_id=123&message_id=%d`, 50+i)).
+			Reply(200).
+			BodyString(fmt.Sprintf(`{"ok":true,"result":{"message_id":%d,"chat":{"id":123},"caption":"new caption"}}`, 50+i))
+	}
+
+	data := editWebhookData("new caption")
+	data.Type = v1.MsgTypeImage
+	data.Items = &items
+
+	require.NoError(t, editSentMessages(bot, b, nil, data))
+	assert.True(t, gock.IsDone())
+}
+
+func TestMapping_markOperatorMessagesRead(t *testing.T) {
+	defer gock.Off()
+	gock.CleanUnmatchedRequest()
+
+	b := newMappingBot()
+	createTestBot(t, b)
+	defer deleteTestBot(b)
+	defer deleteMessageMaps(b.ID, 123, "60", 0)
+
+	m := MessageMap{BotID: b.ID, ChatID: 123, MessageID: 60, ExternalID: "60", Direction: MessageDirectionOut, Kind: MessageKindText}
+	require.NoError(t, m.save())
+
+	gock.New(testMGURL).
+		Post("/messages/read").
+		BodyString(`"external_id":"60"`).
+		Reply(200).
+		BodyString(`{}`)
+
+	// MG is asked once however many times customer messages are processed
+	client := newTestMGClient()
+	markOperatorMessagesRead(client, b, 123)
+	markOperatorMessagesRead(client, b, 123)
+
+	assert.True(t, gock.IsDone())
+	assert.False(t, gock.HasUnmatchedRequest())
+	assert.True(t, getLastMessageMap(b.ID, 123).Read)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	// telegramDownloadLimit is the largest file bots can download from Telegram
+	telegramDownloadLimit = 20 << 20
+	// telegramUploadLimit is the largest file bots can upload to Telegram
+	telegramUploadLimit = 50 << 20
+	// telegramPhotoURLLimit is the largest photo Telegram downloads by URL
+	telegramPhotoURLLimit = 5 << 20
+
+	// fileHeaderSize is how much of the file type detection looks at
+	fileHeaderSize = 262
+
+	// mediaFetchTimeout bounds download of a file including the time it is streamed to the other side
+	mediaFetchTimeout = 5 * time.Minute
+)
+
+// mediaHTTPClient downloads files passed between Telegram and MG
+var mediaHTTPClient = &http.Client{Timeout: mediaFetchTimeout}
+
+// fileTooLargeError is returned when file exceeds the limit, operator is told the limit
+type fileTooLargeError struct {
+	limit int64
+}
+
+func (e *fileTooLargeError) Error() string {
+	return fmt.Sprintf("file exceeds %d MB limit", e.limit>>20)
+}
+
+// limitMB returns the limit in megabytes for messages shown to operator
+func (e *fileTooLargeError) limitMB() int64 {
+	return e.limit >> 20
+}
+
+// isFileTooLarge returns error about exceeded limit, it may come wrapped by HTTP client streaming the file
+func isFileTooLarge(err error) (*fileTooLargeError, bool) {
+	if e, ok := err.(*url.Error); ok {
+		err = e.Err
+	}
+
+	e, ok := err.(*fileTooLargeError)
+
+	return e, ok
+}
+
+// isEntityTooLargeError returns true if Telegram refused uploaded file because of its size
+func isEntityTooLargeError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "Request Entity Too Large")
+}
+
+// fileTooLargeSentError tells operator the file was not delivered because of Telegram limit
+func fileTooLargeSentError(limitMB int64) *MessageSentError {
+	return &MessageSentError{
+		Code:    MessageErrorGeneral,
+		Message: getLocalizedTemplateMessage("file_too_large_upload", map[string]interface{}{"Limit": limitMB}),
+	}
+}
+
+// isFileTooBigError returns true if Telegram refused to give file because of its size
+func isFileTooBigError(err error) bool {
+	e, ok := err.(tgbotapi.Error)
+
+	return ok && strings.Contains(e.Message, "file is too big")
+}
+
+// checkFileSize returns error if file of known size exceeds the limit, zero size means it is unknown
+func checkFileSize(size, limit int64) error {
+	if size > limit {
+		return &fileTooLargeError{limit: limit}
+	}
+
+	return nil
+}
+
+// limitedBody fails reading when the response is larger than the limit
+type limitedBody struct {
+	io.ReadCloser
+	left  int64
+	limit int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.left <= 0 {
+		// body may end right at the limit
+		var one [1]byte
+		if n, _ := b.ReadCloser.Read(one[:]); n > 0 {
+			return 0, &fileTooLargeError{limit: b.limit}
+		}
+
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+
+	return n, err
+}
+
+// fetchFile opens file at URL for streaming, the body is cut at the limit
+func fetchFile(url string, limit int64) (io.ReadCloser, error) {
+	resp, err := mediaHTTPClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		resp.Body.Close()
+		return nil, fmt.Errorf("get file: code %d", resp.StatusCode)
+	}
+
+	if err := checkFileSize(resp.ContentLength, limit); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	return &limitedBody{ReadCloser: resp.Body, left: limit, limit: limit}, nil
+}
+
+// fetchFileHeader downloads the beginning of the file type is detected by,
+// the rest is not requested so that the file is streamed only when it is sent
+func fetchFileHeader(url string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", fileHeaderSize-1))
+
+	resp, err := mediaHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, fmt.Errorf("get file: code %d", resp.StatusCode)
+	}
+
+	// server may ignore the range and send the whole file
+	return ioutil.ReadAll(io.LimitReader(resp.Body, fileHeaderSize))
+}
+
+// remoteFile downloads file when it is read for the first time, so that nothing is fetched for
+// messages which are not sent, the body is closed once it is read to the end or fails
+type remoteFile struct {
+	url   string
+	limit int64
+	body  io.ReadCloser
+	err   error
+}
+
+func newRemoteFile(url string, limit int64) *remoteFile {
+	return &remoteFile{url: url, limit: limit}
+}
+
+func (f *remoteFile) Read(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+
+	if f.body == nil {
+		body, err := fetchFile(f.url, f.limit)
+		if err != nil {
+			f.err = err
+			return 0, err
+		}
+
+		f.body = body
+	}
+
+	n, err := f.body.Read(p)
+	if err != nil {
+		f.body.Close()
+		f.err = err
+	}
+
+	return n, err
+}
+
+// getFileReader returns file for upload to Telegram, unknown size makes Bot API client read it in memory
+func getFileReader(name, url string, size int64) tgbotapi.FileReader {
+	if size <= 0 {
+		size = -1
+	}
+
+	return tgbotapi.FileReader{
+		Name:   name,
+		Reader: newRemoteFile(url, telegramUploadLimit),
+		Size:   size,
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/h2non/gock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMedia_fetchFile(t *testing.T) {
+	defer gock.Off()
+
+	gock.New("https://files.example.com").
+		Get("/small").
+		Reply(200).
+		BodyString("image")
+
+	body, err := fetchFile("https://files.example.com/small", 5)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "image", string(data))
+
+	gock.New("https://files.example.com").
+		Get("/large").
+		Reply(200).
+		BodyString("large image")
+
+	body, err = fetchFile("https://files.example.com/large", 5)
+	if err == nil {
+		// size is not known until the body is read
+		_, err = ioutil.ReadAll(body)
+		body.Close()
+	}
+	e, ok := isFileTooLarge(err)
+	require.True(t, ok)
+	assert.Equal(t, int64(5), e.limit)
+
+	gock.New("https://files.example.com").
+		Get("/missing").
+		Reply(404)
+
+	_, err = fetchFile("https://files.example.com/missing", 5)
+	assert.EqualError(t, err, "get file: code 404")
+}
+
+func TestMedia_remoteFile(t *testing.T) {
+	defer gock.Off()
+
+	gock.New("https://files.example.com").
+		Get("/doc").
+		Reply(200).
+		BodyString("document")
+
+	f := newRemoteFile("https://files.example.com/doc", telegramUploadLimit)
+	assert.Nil(t, f.body)
+
+	data, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "document", string(data))
+	assert.True(t, gock.IsDone())
+}
+
+func TestMedia_fileTooLargeSentError(t *testing.T) {
+	setLocale("en")
+
+	err := checkFileSize(60<<20, telegramUploadLimit)
+
+	retry, _ := retryableSendError(err)
+	assert.False(t, retry)
+	assert.Contains(t, getMessageSentError(err).Message, "50")
+
+	retry, _ = retryableSendError(errors.New("Request Entity Too Large"))
+	assert.False(t, retry)
+	assert.Contains(t, getMessageSentError(errors.New("Request Entity Too Large")).Message, "50")
+
+	assert.NoError(t, checkFileSize(0, telegramUploadLimit))
+}
+
+func TestMedia_fetchFileHeader(t *testing.T) {
+	defer gock.Off()
+
+	gock.New("https://files.example.com").
+		Get("/voice").
+		MatchHeader("Range", "bytes=0-261").
+		Reply(206).
+		BodyString("OggS")
+
+	head, err := fetchFileHeader("https://files.example.com/voice")
+	require.NoError(t, err)
+	assert.Equal(t, "OggS", string(head))
+
+	// whole file is sent if range is not supported
+	gock.New("https://files.example.com").
+		Get("/large").
+		Reply(200).
+		BodyString(strings.Repeat("a", 1000))
+
+	head, err = fetchFileHeader("https://files.example.com/large")
+	require.NoError(t, err)
+	assert.Len(t, head, fileHeaderSize)
+
+	gock.New("https://files.example.com").
+		Get("/missing").
+		Reply(404)
+
+	_, err = fetchFileHeader("https://files.example.com/missing")
+	assert.EqualError(t, err, "get file: code 404")
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	v1 "github.com/retailcrm/mg-transport-api-client-go/v1"
+)
+
+const (
+	// MessageErrorGeneral is reported when Telegram rejected the message
+	MessageErrorGeneral = "general"
+	// MessageErrorCustomerNotExists is reported when the chat is gone or the bot was blocked
+	MessageErrorCustomerNotExists = "customer_not_exists"
+
+	// SuggestionTypeText is a quick reply, customer sends its title by tapping it
+	SuggestionTypeText = "text"
+	// SuggestionTypePhone asks customer to share the phone number
+	SuggestionTypePhone = "phone"
+	// SuggestionTypeEmail asks customer for email, Telegram can't share it so it is shown as a quick reply
+	SuggestionTypeEmail = "email"
+	// SuggestionTypeURL opens link from payload
+	SuggestionTypeURL = "url"
+)
+
+// WebhookRequest is MG webhook with data not supported by the API client yet
+type WebhookRequest struct {
+	Type string                  `json:"type"`
+	Meta v1.TransportRequestMeta `json:"meta"`
+	Data WebhookData             `json:"data"`
+}
+
+// WebhookData is message data with buttons attached by operator
+type WebhookData struct {
+	v1.WebhookData
+	TransportAttachments *TransportAttachments `json:"transport_attachments,omitempty"`
+}
+
+// TransportAttachments contains transport specific message data
+type TransportAttachments struct {
+	Suggestions []Suggestion `json:"suggestions,omitempty"`
+}
+
+// Suggestion is a button shown to customer under the message
+type Suggestion struct {
+	Type    string `json:"type"`
+	Title   string `json:"title"`
+	Payload string `json:"payload,omitempty"`
+}
+
+// Channel is MG channel with settings not supported by the API client yet
+type Channel struct {
+	v1.Channel
+	Settings ChannelSettings `json:"settings"`
+}
+
+// ChannelSettings adds audio messages and suggestions support to channel settings
+type ChannelSettings struct {
+	v1.ChannelSettings
+	Audio       ChannelSettingsAudio       `json:"audio"`
+	Suggestions ChannelSettingsSuggestions `json:"suggestions"`
+}
+
+// ChannelSettingsSuggestions lists suggestion types the channel shows to customer
+type ChannelSettingsSuggestions struct {
+	Text  string `json:"text,omitempty"`
+	Phone string `json:"phone,omitempty"`
+	Email string `json:"email,omitempty"`
+	URL   string `json:"url,omitempty"`
+}
+
+// ChannelSettingsAudio describes audio messages capabilities of the channel
+type ChannelSettingsAudio struct {
+	Creating string `json:"creating,omitempty"`
+	Quoting  string `json:"quoting,omitempty"`
+	Deleting string `json:"deleting,omitempty"`
+	Max      uint64 `json:"max_items_count,omitempty"`
+}
+
+// MessageSentResponse is the answer to message_sent webhook
+type MessageSentResponse struct {
+	ExternalMessageID string            `json:"external_message_id,omitempty"`
+	Error             *MessageSentError `json:"error,omitempty"`
+}
+
+// MessageSentError describes why message was not delivered
+type MessageSentError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// activateTransportChannel activates channel with extended settings
+func activateTransportChannel(client *v1.MgClient, request Channel) (v1.ActivateResponse, int, error) {
+	var resp v1.ActivateResponse
+	outgoing, _ := json.Marshal(&request)
+
+	data, status, err := client.PostRequest("/channels", bytes.NewBuffer(outgoing))
+	if err != nil {
+		return resp, status, err
+	}
+
+	if e := json.Unmarshal(data, &resp); e != nil {
+		return resp, status, e
+	}
+
+	if status > http.StatusCreated || status < http.StatusOK {
+		return resp, status, client.Error(data)
+	}
+
+	return resp, status, nil
+}
+
+// updateTransportChannel updates channel with extended settings
+func updateTransportChannel(client *v1.MgClient, request Channel) (v1.UpdateResponse, int, error) {
+	var resp v1.UpdateResponse
+	outgoing, _ := json.Marshal(&request)
+
+	data, status, err := client.PutRequest(fmt.Sprintf("/channels/%d", request.ID), outgoing)
+	if err != nil {
+		return resp, status, err
+	}
+
+	if e := json.Unmarshal(data, &resp); e != nil {
+		return resp, status, e
+	}
+
+	if status != http.StatusOK {
+		return resp, status, client.Error(data)
+	}
+
+	return resp, status, nil
+}
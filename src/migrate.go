@@ -24,7 +24,7 @@ type MigrateCommand struct {
 
 // Execute method
 func (x *MigrateCommand) Execute(args []string) error {
-	config := LoadConfig(options.Config)
+	config = LoadConfig(options.Config)
 
 	err := Migrate(config.Database.Connection, x.Version, x.Path)
 	if err != nil && err.Error() == "no change" {
@@ -32,6 +32,18 @@ func (x *MigrateCommand) Execute(args []string) error {
 		err = nil
 	}
 
+	if err != nil || x.Version != "up" {
+		return err
+	}
+
+	orm = NewDb(config)
+	defer orm.Close()
+
+	count, err := encryptSecrets(false)
+	if count > 0 {
+		fmt.Printf("Updated secrets of %d records\n", count)
+	}
+
 	return err
 }
 
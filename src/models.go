@@ -4,27 +4,39 @@ import "time"
 
 // Connection model
 type Connection struct {
-	ID        int    `gorm:"primary_key"`
-	ClientID  string `gorm:"client_id type:varchar(70);not null;unique" json:"clientId,omitempty"`
-	APIKEY    string `gorm:"api_key type:varchar(100);not null" json:"api_key,omitempty" binding:"required,max=100"`
-	APIURL    string `gorm:"api_url type:varchar(255);not null" json:"api_url,omitempty" binding:"required,validatecrmurl,max=255"`
-	MGURL     string `gorm:"mg_url type:varchar(255);not null;" json:"mg_url,omitempty" binding:"max=255"`
-	MGToken   string `gorm:"mg_token type:varchar(100);not null;unique" json:"mg_token,omitempty" binding:"max=100"`
+	ID        int             `gorm:"primary_key"`
+	ClientID  string          `gorm:"client_id type:varchar(70);not null;unique" json:"clientId,omitempty"`
+	APIKEY    EncryptedString `gorm:"api_key type:text;not null" json:"api_key,omitempty" binding:"required,max=100"`
+	APIURL    string          `gorm:"api_url type:varchar(255);not null" json:"api_url,omitempty" binding:"required,validatecrmurl,max=255"`
+	MGURL     string          `gorm:"mg_url type:varchar(255);not null;" json:"mg_url,omitempty" binding:"max=255"`
+	MGToken   EncryptedString `gorm:"mg_token type:text;not null" json:"mg_token,omitempty" binding:"max=100"`
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	Active    bool  `json:"active,omitempty"`
 	Bots      []Bot `gorm:"foreignkey:ConnectionID"`
+	// ReconciledAt and ReconciledHash tell when MG channels were last reconciled and with what settings
+	ReconciledAt   *time.Time `gorm:"reconciled_at" json:"-"`
+	ReconciledHash string     `gorm:"reconciled_hash type:varchar(70)" json:"-"`
+	// ModuleHash tells with what settings the integration module was registered in retailCRM
+	ModuleHash string `gorm:"module_hash type:varchar(70)" json:"-"`
 }
 
 // Bot model
 type Bot struct {
-	ID                  int    `gorm:"primary_key"`
-	ConnectionID        int    `gorm:"connection_id" json:"connectionId,omitempty"`
-	Channel             uint64 `gorm:"channel;not null;unique" json:"channel,omitempty"`
-	ChannelSettingsHash string `gorm:"channel_settings_hash type:varchar(70)" binding:"max=70"`
-	Token               string `gorm:"token type:varchar(100);not null;unique" json:"token,omitempty" binding:"max=100"`
-	Name                string `gorm:"name type:varchar(40)" json:"name,omitempty" binding:"max=40"`
-	Lang                string `gorm:"lang type:varchar(2)" json:"lang,omitempty" binding:"max=2"`
+	ID                  int             `gorm:"primary_key"`
+	ConnectionID        int             `gorm:"connection_id" json:"connectionId,omitempty"`
+	Channel             uint64          `gorm:"channel;not null;unique" json:"channel,omitempty"`
+	ChannelSettingsHash string          `gorm:"channel_settings_hash type:varchar(70)" binding:"max=70"`
+	Token               EncryptedString `gorm:"token type:text;not null" json:"token,omitempty" binding:"max=100"`
+	TokenHash           string          `gorm:"token_hash type:varchar(64);unique" json:"-"`
+	Name                string          `gorm:"name type:varchar(40)" json:"name,omitempty" binding:"max=40"`
+	Lang                string          `gorm:"lang type:varchar(2)" json:"lang,omitempty" binding:"max=2"`
+	UpdateMode          string          `gorm:"update_mode type:varchar(10)" json:"mode,omitempty" binding:"max=10"`
+	UpdateOffset        int             `gorm:"update_offset" json:"-"`
+	GroupMode           string          `gorm:"group_mode type:varchar(10)" json:"groupMode,omitempty" binding:"max=10"`
+	WebhookID           string          `gorm:"webhook_id type:varchar(64);unique" json:"-"`
+	WebhookSecret       string          `gorm:"webhook_secret type:varchar(64)" json:"-"`
+	WebhookMigrated     bool            `gorm:"webhook_migrated" json:"-"`
 	CreatedAt           time.Time
 	UpdatedAt           time.Time
 }
@@ -43,5 +55,84 @@ func (User) TableName() string {
 	return "mg_user"
 }
 
-//Bots list
+// CRMCustomer links Telegram user to retailCRM customer of the connection, zero CustomerID means no customer matched
+type CRMCustomer struct {
+	ID             int `gorm:"primary_key"`
+	ConnectionID   int `gorm:"connection_id;not null"`
+	UserExternalID int `gorm:"user_external_id;not null"`
+	CustomerID     int `gorm:"customer_id;not null"`
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// InboundUpdate model
+type InboundUpdate struct {
+	ID            int    `gorm:"primary_key"`
+	BotID         int    `gorm:"bot_id;not null"`
+	UpdateID      int    `gorm:"update_id;not null"`
+	ChatID        int64  `gorm:"chat_id;not null"`
+	Payload       string `gorm:"payload type:text;not null"`
+	Status        string `gorm:"status type:varchar(16);not null"`
+	Attempts      int    `gorm:"attempts;not null"`
+	LastError     string `gorm:"last_error type:text"`
+	NextAttemptAt time.Time
+	LockedAt      *time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// OutboundMessage model
+type OutboundMessage struct {
+	ID            int    `gorm:"primary_key"`
+	BotID         int    `gorm:"bot_id;not null"`
+	ChatID        int64  `gorm:"chat_id;not null"`
+	MessageID     int    `gorm:"message_id"`
+	Payload       string `gorm:"payload type:text;not null"`
+	Status        string `gorm:"status type:varchar(16);not null"`
+	Attempts      int    `gorm:"attempts;not null"`
+	LastError     string `gorm:"last_error type:text"`
+	NextAttemptAt time.Time
+	LockedAt      *time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	// ExternalID is given to MG when first parts were sent before the rest was queued
+	ExternalID string `gorm:"external_id type:varchar(32)"`
+}
+
+// MessageMap links MG message to Telegram messages it was received or sent as,
+// long messages and albums are sent as several Telegram messages numbered by part
+type MessageMap struct {
+	ID          int    `gorm:"primary_key"`
+	BotID       int    `gorm:"bot_id;not null"`
+	ChatID      int64  `gorm:"chat_id;not null"`
+	MessageID   int    `gorm:"message_id;not null"`
+	ExternalID  string `gorm:"external_id type:varchar(32);not null"`
+	MGMessageID int64  `gorm:"column:mg_message_id"`
+	Part        int    `gorm:"part;not null"`
+	Direction   string `gorm:"direction type:varchar(3);not null"`
+	Kind        string `gorm:"kind type:varchar(16)"`
+	FileID      string `gorm:"file_id type:varchar(64)"`
+	CreatedAt   time.Time
+	// Read tells outbound message was reported to MG as read
+	Read bool `gorm:"read;not null"`
+}
+
+// ChatState keeps whether the bot can write to the chat, customer may block the bot or remove it from the group
+type ChatState struct {
+	ID        int   `gorm:"primary_key"`
+	BotID     int   `gorm:"bot_id;not null"`
+	ChatID    int64 `gorm:"chat_id;not null"`
+	Blocked   bool  `gorm:"blocked;not null"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// BeforeSave keeps lookup hash in sync with the encrypted token
+func (b *Bot) BeforeSave() error {
+	b.TokenHash = secretHash(string(b.Token))
+
+	return nil
+}
+
+// Bots list
 type Bots []Bot
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	v1 "github.com/retailcrm/mg-transport-api-client-go/v1"
+)
+
+const (
+	// Telegram allows about 30 messages per second for a bot, one message per second
+	// in a private chat and 20 messages per minute in a group
+	telegramBotSendInterval   = time.Second / 30
+	telegramChatSendInterval  = time.Second
+	telegramGroupSendInterval = 3 * time.Second
+
+	// limiterSweepInterval is how often slots already passed are removed from rate limiter
+	limiterSweepInterval = time.Minute
+
+	// queuedMessagePrefix marks external message IDs of messages delivered by the outbound queue
+	queuedMessagePrefix = "q"
+	// callbackMessagePrefix marks external message IDs of inline button taps sent to MG
+	callbackMessagePrefix = "c"
+	// memberMessagePrefix marks external message IDs of notifications about customer blocking the bot
+	memberMessagePrefix = "m"
+)
+
+var (
+	errEmptyMessage = errors.New("nothing to send")
+	sendLimiter     = &rateLimiter{next: map[string]time.Time{}}
+)
+
+// rateLimiter spaces out events with the same key
+type rateLimiter struct {
+	mu    sync.Mutex
+	next  map[string]time.Time
+	swept time.Time
+}
+
+// reserve books the next free slot for key and returns how long to wait for it
+func (l *rateLimiter) reserve(key string, interval time.Duration) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.swept) >= limiterSweepInterval {
+		l.sweep(now)
+	}
+
+	slot := l.next[key]
+	if slot.Before(now) {
+		slot = now
+	}
+
+	l.next[key] = slot.Add(interval)
+
+	return slot.Sub(now)
+}
+
+// sweep removes keys whose next slot has passed, they are free anyway
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, slot := range l.next {
+		if slot.Before(now) {
+			delete(l.next, key)
+		}
+	}
+
+	l.swept = now
+}
+
+// postpone makes key unavailable until the given time
+func (l *rateLimiter) postpone(key string, until time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.next[key].Before(until) {
+		l.next[key] = until
+	}
+}
+
+func chatLimiterKey(b *Bot, cid int64) string {
+	return fmt.Sprintf("chat:%d:%d", b.ID, cid)
+}
+
+// reserveSend books a send slot respecting both bot and chat limits
+func reserveSend(b *Bot, cid int64) time.Duration {
+	interval := telegramChatSendInterval
+	if cid < 0 {
+		interval = telegramGroupSendInterval
+	}
+
+	botDelay := sendLimiter.reserve(fmt.Sprintf("bot:%d", b.ID), telegramBotSendInterval)
+	chatDelay := sendLimiter.reserve(chatLimiterKey(b, cid), interval)
+
+	if botDelay > chatDelay {
+		return botDelay
+	}
+
+	return chatDelay
+}
+
+func postponeSend(b *Bot, cid int64, after time.Duration) {
+	if after > 0 {
+		sendLimiter.postpone(chatLimiterKey(b, cid), time.Now().Add(after))
+	}
+}
+
+// retryableSendError returns true if sending may succeed later and the delay requested by Telegram
+func retryableSendError(err error) (bool, time.Duration) {
+	if _, ok := err.(*panicError); ok {
+		return false, 0
+	}
+
+	if _, ok := isFileTooLarge(err); ok || isEntityTooLargeError(err) {
+		return false, 0
+	}
+
+	e, ok := err.(tgbotapi.Error)
+	if !ok {
+		// only network failures are transient, others like broken payload repeat on every attempt
+		return isNetworkError(err), 0
+	}
+
+	if e.RetryAfter > 0 {
+		return true, time.Duration(e.RetryAfter) * time.Second
+	}
+
+	return strings.HasPrefix(e.Message, "Too Many Requests") ||
+		strings.HasPrefix(e.Message, "Internal Server Error") ||
+		strings.HasPrefix(e.Message, "Bad Gateway") ||
+		strings.HasPrefix(e.Message, "Gateway Timeout"), 0
+}
+
+func isNetworkError(err error) bool {
+	switch err.(type) {
+	case *url.Error, net.Error:
+		return true
+	default:
+		return false
+	}
+}
+
+// isBlockedError returns true if Telegram refused to send because customer blocked the bot or removed it from the chat
+func isBlockedError(err error) bool {
+	e, ok := err.(tgbotapi.Error)
+
+	return ok && (strings.Contains(e.Message, "bot was blocked by the user") ||
+		strings.Contains(e.Message, "user is deactivated") ||
+		strings.Contains(e.Message, "bot was kicked"))
+}
+
+func blockedChatError() *MessageSentError {
+	return &MessageSentError{Code: MessageErrorCustomerNotExists, Message: "blocked by user"}
+}
+
+// flagBlockedChat remembers the chat is blocked when sending failed because of it
+func flagBlockedChat(b *Bot, cid int64, err error) {
+	if !isBlockedError(err) {
+		return
+	}
+
+	if e := setChatBlocked(b.ID, cid, true); e != nil {
+		logger.Errorf("flagBlockedChat bot %d chat %d: %s", b.ID, cid, e.Error())
+	}
+}
+
+// getMessageSentError describes Telegram error for MG so that operator sees why message was not delivered
+func getMessageSentError(err error) *MessageSentError {
+	if e, ok := isFileTooLarge(err); ok {
+		return fileTooLargeSentError(e.limitMB())
+	}
+
+	if isEntityTooLargeError(err) {
+		return fileTooLargeSentError(telegramUploadLimit >> 20)
+	}
+
+	e, ok := err.(tgbotapi.Error)
+	if !ok {
+		return &MessageSentError{Code: MessageErrorGeneral, Message: err.Error()}
+	}
+
+	switch {
+	case isBlockedError(err):
+		return blockedChatError()
+	case strings.Contains(e.Message, "chat not found"):
+		return &MessageSentError{Code: MessageErrorCustomerNotExists, Message: "chat not found"}
+	case e.RetryAfter > 0, strings.HasPrefix(e.Message, "Too Many Requests"):
+		return &MessageSentError{Code: MessageErrorGeneral, Message: "rate limited"}
+	default:
+		return &MessageSentError{Code: MessageErrorGeneral, Message: e.Message}
+	}
+}
+
+// getTelegramMessageID resolves external message ID given to MG into Telegram message ID
+func getTelegramMessageID(externalID string) int {
+	if strings.HasPrefix(externalID, queuedMessagePrefix) {
+		id, _ := strconv.Atoi(strings.TrimPrefix(externalID, queuedMessagePrefix))
+
+		return getOutboundMessage(id).MessageID
+	}
+
+	id, _ := strconv.Atoi(externalID)
+
+	return id
+}
+
+func (m *OutboundMessage) externalID() string {
+	if m.ExternalID != "" {
+		return m.ExternalID
+	}
+
+	return queuedMessagePrefix + strconv.Itoa(m.ID)
+}
+
+// enqueueWebhookMessage stores message for delivery by the outbound queue and answers MG with its external ID.
+// Only messages Telegram failed to take for a transient reason are queued, and the ones following them in the
+// chat to keep the order, MG transport API can not be told about later failure so final failure is logged.
+// External ID of the parts sent before the failure is kept for the rest of them
+func enqueueWebhookMessage(c *gin.Context, b *Bot, cid int64, msg WebhookRequest, externalID string) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	m := OutboundMessage{
+		BotID:      b.ID,
+		ChatID:     cid,
+		ExternalID: externalID,
+		Payload:    string(payload),
+	}
+
+	if err := m.enqueue(); err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, MessageSentResponse{ExternalMessageID: m.externalID()})
+}
+
+func startOutboundQueue() *Workers {
+	qc := config.OutboundQueue.withDefaults()
+	lockTimeout := time.Duration(qc.LockTimeout) * time.Second
+
+	w := newWorkers()
+	w.run(qc.Workers, time.Duration(qc.PollInterval)*time.Second, func() bool {
+		return processOutboundMessage(qc)
+	})
+	w.run(1, lockTimeout, func() bool {
+		if err := releaseStaleQueued("outbound_message", time.Now().Add(-lockTimeout)); err != nil {
+			logger.Error("releaseStaleQueued outbound_message:", err)
+		}
+
+		// sent messages are resolved through message map, the rows are kept only for inspection
+		if err := deleteFinishedQueued("outbound_message", queueStatusSent, time.Now().Add(-qc.getRetention())); err != nil {
+			logger.Error("deleteFinishedQueued outbound_message:", err)
+		}
+
+		return false
+	})
+
+	return w
+}
+
+func processOutboundMessage(qc QueueConfig) bool {
+	m, err := claimOutboundMessage()
+	if err != nil {
+		logger.Error("claimOutboundMessage:", err)
+		return false
+	}
+
+	if m == nil {
+		return false
+	}
+
+	b := getBotByID(m.BotID)
+	conn := getCachedConnectionByID(b.ConnectionID)
+	if b.ID == 0 || conn.ID == 0 {
+		if err := m.bury(errors.New("bot not found")); err != nil {
+			logger.Errorf("outbound message %d: %s", m.ID, err.Error())
+		}
+
+		return true
+	}
+
+	if isChatBlocked(b.ID, m.ChatID) {
+		if err := m.bury(errors.New("chat is blocked")); err != nil {
+			logger.Errorf("outbound message %d: %s", m.ID, err.Error())
+		}
+
+		return true
+	}
+
+	mgClient := getMGClient(conn)
+
+	var messageID int
+	err = recoverJob(func() (err error) {
+		messageID, err = sendOutboundMessage(conn, b, m, mgClient)
+		return err
+	})
+	if err == nil {
+		if err := m.sent(messageID); err != nil {
+			logger.Errorf("outbound message %d: %s", m.ID, err.Error())
+		}
+
+		return true
+	}
+
+	retry, after := retryableSendError(err)
+	if retry && m.Attempts < qc.MaxAttempts {
+		delay := retryDelay(qc, m.Attempts)
+		if after > delay {
+			delay = after
+		}
+
+		postponeSend(b, m.ChatID, after)
+		logger.Warningf("outbound message %d: attempt %d failed: %s", m.ID, m.Attempts, err.Error())
+		err = m.retry(err, time.Now().Add(delay))
+		if err != nil {
+			logger.Errorf("outbound message %d: %s", m.ID, err.Error())
+		}
+
+		return true
+	}
+
+	logger.Errorf("outbound message %d: giving up after %d attempts: %s", m.ID, m.Attempts, err.Error())
+	flagBlockedChat(b, m.ChatID, err)
+	if e := m.bury(err); e != nil {
+		logger.Errorf("outbound message %d: %s", m.ID, e.Error())
+	}
+
+	return true
+}
+
+// sendOutboundMessage sends all parts of the message and returns ID of the first one,
+// parts mapped by previous attempts are skipped
+func sendOutboundMessage(conn *Connection, b *Bot, m *OutboundMessage, mgClient *v1.MgClient) (int, error) {
+	var msg WebhookRequest
+	if err := json.Unmarshal([]byte(m.Payload), &msg); err != nil {
+		return 0, err
+	}
+
+	bot, err := getBotAPI(b)
+	if err != nil {
+		return 0, err
+	}
+	setLocale(b.Lang)
+
+	messages, err := getWebhookMessage(conn, b, msg.Data, mgClient, m.ChatID, getFormatter())
+	if err != nil {
+		return 0, err
+	}
+
+	firstID, _, err := sendWebhookParts(conn, b, bot, msg.Data, mgClient, m.ChatID, messages, m.externalID())
+
+	return firstID, err
+}
+
+// sendWebhookParts sends messages built from MG message one by one, parts mapped to the external ID
+// by previous attempts are skipped. Message sent inline gets ID of its first Telegram message as external ID,
+// it is returned once the first part is sent, together with the ID of that part
+func sendWebhookParts(
+	conn *Connection, b *Bot, bot *tgbotapi.BotAPI, data WebhookData, mgClient *v1.MgClient, cid int64,
+	messages []tgbotapi.Chattable, externalID string,
+) (int, string, error) {
+	var (
+		firstID int
+		part    int
+		sent    []MessageMap
+	)
+
+	if externalID != "" {
+		sent = getMessageMaps(b.ID, cid, externalID)
+	}
+
+	if len(sent) > 0 {
+		firstID = sent[0].MessageID
+	}
+
+	for i, message := range messages {
+		if part+chattableSize(message) <= len(sent) {
+			part += chattableSize(message)
+			continue
+		}
+
+		time.Sleep(reserveSend(b, cid))
+
+		index := i
+		msgSend, err := sendWithFallback(bot, message, func() (tgbotapi.Chattable, error) {
+			plain, err := getWebhookMessage(conn, b, data, mgClient, cid, plainFormatter{})
+			if err != nil || index >= len(plain) {
+				return nil, errEmptyMessage
+			}
+
+			return plain[index], nil
+		})
+		if err != nil {
+			return firstID, externalID, err
+		}
+
+		if len(msgSend) == 0 {
+			continue
+		}
+
+		if part == 0 {
+			firstID = msgSend[0].MessageID
+			if externalID == "" {
+				externalID = strconv.Itoa(firstID)
+			}
+		}
+
+		if err := saveSentMessages(b, cid, externalID, part, msgSend, getItemIDs(data)); err != nil {
+			logger.Errorf("sendWebhookParts bot %d chat %d: part %d: %s", b.ID, cid, part, err.Error())
+		}
+
+		part += len(msgSend)
+	}
+
+	return firstID, externalID, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/h2non/gock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutbound_getMessageSentError(t *testing.T) {
+	blocked := getMessageSentError(tgbotapi.Error{Message: "Forbidden: bot was blocked by the user"})
+	assert.Equal(t, MessageErrorCustomerNotExists, blocked.Code)
+	assert.Equal(t, "blocked by user", blocked.Message)
+
+	notFound := getMessageSentError(tgbotapi.Error{Message: "Bad Request: chat not found"})
+	assert.Equal(t, MessageErrorCustomerNotExists, notFound.Code)
+
+	limited := getMessageSentError(tgbotapi.Error{Message: "Too Many Requests: retry after 5", ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 5}})
+	assert.Equal(t, MessageErrorGeneral, limited.Code)
+	assert.Equal(t, "rate limited", limited.Message)
+}
+
+func TestOutbound_retryableSendError(t *testing.T) {
+	cases := []struct {
+		err   error
+		retry bool
+		after time.Duration
+	}{
+		{&url.Error{Op: "Post", URL: "https://api.telegram.org", Err: errors.New("connection reset")}, true, 0},
+		{&net.OpError{Op: "dial", Err: errors.New("timeout")}, true, 0},
+		{tgbotapi.Error{Message: "Too Many Requests: retry after 5", ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 5}}, true, 5 * time.Second},
+		{tgbotapi.Error{Message: "Bad Gateway"}, true, 0},
+		{tgbotapi.Error{Message: "Bad Request: chat not found"}, false, 0},
+		{errEmptyMessage, false, 0},
+		{&url.Error{Op: "Get", URL: "https://mg.example.com", Err: &fileTooLargeError{limit: telegramUploadLimit}}, false, 0},
+		{errors.New("invalid character '<' looking for beginning of value"), false, 0},
+		{&panicError{value: "failed"}, false, 0},
+	}
+
+	for _, c := range cases {
+		retry, after := retryableSendError(c.err)
+		assert.Equal(t, c.retry, retry, c.err.Error())
+		assert.Equal(t, c.after, after, c.err.Error())
+	}
+}
+
+func TestOutbound_rateLimiter(t *testing.T) {
+	l := &rateLimiter{next: map[string]time.Time{}}
+
+	assert.Zero(t, l.reserve("chat:1:1", time.Second))
+	assert.InDelta(t, float64(time.Second), float64(l.reserve("chat:1:1", time.Second)), float64(50*time.Millisecond))
+	assert.Zero(t, l.reserve("chat:1:2", time.Second))
+
+	l.postpone("chat:1:2", time.Now().Add(time.Minute))
+	assert.True(t, l.reserve("chat:1:2", time.Second) > 50*time.Second)
+
+	// keys whose slot has passed are swept
+	l.next["chat:1:3"] = time.Now().Add(-time.Second)
+	l.swept = time.Time{}
+	l.reserve("bot:1", time.Millisecond)
+	_, ok := l.next["chat:1:3"]
+	assert.False(t, ok)
+	assert.Contains(t, l.next, "chat:1:1")
+}
+
+func TestOutbound_sendWebhookParts(t *testing.T) {
+	defer gock.Off()
+
+	b := newMappingBot()
+	bot := createTestBot(t, b)
+	defer deleteTestBot(b)
+	defer deleteMessageMaps(b.ID, 123, "10", 0)
+
+	messages := []tgbotapi.Chattable{
+		tgbotapi.NewMessage(123, "first"),
+		tgbotapi.NewMessage(123, "second"),
+		tgbotapi.NewMessage(123, "third"),
+	}
+
+	gock.New("https://api.telegram.org").
+		Post("/bot9000003:Mapping/sendMessage").
+		Reply(200).
+		BodyString(`{"ok":true,"result":{"message_id":10,"chat":{"id":123},"text":"first"}}`)
+	gock.New("https://api.telegram.org").
+		Post("/bot9000003:Mapping/sendMessage").
+		Reply(500).
+		BodyString(`{"ok":false,"error_code":500,"description":"Internal Server Error"}`)
+
+	// MG gets ID of the first part even if the rest is queued
+	firstID, externalID, err := sendWebhookParts(nil, b, bot, WebhookData{}, nil, 123, messages, "")
+	require.Error(t, err)
+	retry, _ := retryableSendError(err)
+	assert.True(t, retry)
+	assert.Equal(t, 10, firstID)
+	assert.Equal(t, "10", externalID)
+
+	gock.New("https://api.telegram.org").
+		Post("/bot9000003:Mapping/sendMessage").
+		MatchType("url").
+		BodyString(`text=second`).
+		Reply(200).
+		BodyString(`{"ok":true,"result":{"message_id":11,"chat":{"id":123},"text":"second"}}`)
+	gock.New("https://api.telegram.org").
+		Post("/bot9000003:Mapping/sendMessage").
+		MatchType("url").
+		BodyString(`text=third`).
+		Reply(200).
+		BodyString(`{"ok":true,"result":{"message_id":12,"chat":{"id":123},"text":"third"}}`)
+
+	firstID, externalID, err = sendWebhookParts(nil, b, bot, WebhookData{}, nil, 123, messages, "10")
+	require.NoError(t, err)
+	assert.Equal(t, 10, firstID)
+	assert.Equal(t, "10", externalID)
+	assert.True(t, gock.IsDone())
+
+	maps := getMessageMaps(b.ID, 123, "10")
+	if assert.Len(t, maps, 3) {
+		assert.Equal(t, 12, maps[2].MessageID)
+	}
+}
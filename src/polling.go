@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	// UpdateModeWebhook bot receives updates via webhook
+	UpdateModeWebhook = "webhook"
+	// UpdateModePolling bot receives updates via getUpdates long polling
+	UpdateModePolling = "polling"
+
+	pollingTimeout         = 30
+	pollingLimit           = 100
+	pollingErrorDelay      = 5 * time.Second
+	pollingRefreshInterval = 10 * time.Second
+
+	// advisory lock namespace guarding getUpdates of a bot across replicas
+	pollingLockNamespace int32 = 1
+)
+
+// errBotNotFound stops polling of the bot deleted meanwhile
+var errBotNotFound = errors.New("bot not found")
+
+type updateModeOption struct {
+	Value string
+	Label string
+}
+
+func isValidUpdateMode(mode string) bool {
+	return mode == "" || mode == UpdateModeWebhook || mode == UpdateModePolling
+}
+
+func getUpdateModeOptions() []updateModeOption {
+	return []updateModeOption{
+		{UpdateModeWebhook, getLocalizedMessage("update_mode_webhook")},
+		{UpdateModePolling, getLocalizedMessage("update_mode_polling")},
+	}
+}
+
+// getUpdateMode returns bot update mode falling back to deployment default
+func (b *Bot) getUpdateMode() string {
+	if b.UpdateMode != "" {
+		return b.UpdateMode
+	}
+
+	if config.UpdateMode == UpdateModePolling {
+		return UpdateModePolling
+	}
+
+	return UpdateModeWebhook
+}
+
+// startPolling runs long polling for bots in polling mode, bots are rechecked periodically
+func startPolling() *Workers {
+	w := newWorkers()
+	pollers := map[int]chan struct{}{}
+
+	w.run(1, pollingRefreshInterval, func() bool {
+		active := map[int]bool{}
+
+		for _, b := range getBots() {
+			if b.getUpdateMode() != UpdateModePolling {
+				continue
+			}
+
+			active[b.ID] = true
+			if _, ok := pollers[b.ID]; ok {
+				continue
+			}
+
+			stop := make(chan struct{})
+			pollers[b.ID] = stop
+
+			// pollers are not awaited on Stop as a long poll request can't be interrupted,
+			// offsets are saved after every batch and queued updates are deduplicated
+			go pollBot(b.ID, stop, w.stop)
+		}
+
+		for id, stop := range pollers {
+			if !active[id] {
+				close(stop)
+				delete(pollers, id)
+				restoreWebhook(id)
+			}
+		}
+
+		return false
+	})
+
+	return w
+}
+
+// pollBot fetches updates of the bot into the inbound queue until stopped
+func pollBot(id int, stops ...chan struct{}) {
+	var lock *AdvisoryLock
+
+	defer func() {
+		if lock != nil {
+			lock.Release()
+		}
+	}()
+
+	for {
+		for _, stop := range stops {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+
+		var err error
+		if lock == nil {
+			lock, err = orm.tryAdvisoryLock(pollingLockNamespace, int32(id))
+
+			// getUpdates fails with 409 Conflict while webhook is set
+			if err == nil && lock != nil {
+				err = removeWebhook(id)
+			}
+		}
+
+		if err == nil && lock != nil {
+			err = pollUpdates(id)
+		}
+
+		if err == errBotNotFound {
+			return
+		}
+
+		if err != nil {
+			logger.Errorf("pollBot %d: %s", id, err.Error())
+		}
+
+		if err != nil || lock == nil {
+			time.Sleep(pollingErrorDelay)
+		}
+	}
+}
+
+// removeWebhook deletes webhook of the bot switched to polling mode
+func removeWebhook(id int) error {
+	b := getBotByID(id)
+	if b.ID == 0 {
+		return errBotNotFound
+	}
+
+	bot, err := getBotAPI(b)
+	if err != nil {
+		return err
+	}
+
+	if _, err = bot.RemoveWebhook(); err != nil {
+		return err
+	}
+
+	if !b.WebhookMigrated {
+		return b.setWebhookMigrated()
+	}
+
+	return nil
+}
+
+// restoreWebhook sets webhook of the bot switched back to webhook mode, deleted bots are skipped
+func restoreWebhook(id int) {
+	b := getBotByID(id)
+	if b.ID == 0 || b.getUpdateMode() != UpdateModeWebhook {
+		return
+	}
+
+	bot, err := getBotAPI(b)
+	if err == nil {
+		_, err = setWebhook(bot, b)
+	}
+
+	if err == nil && !b.WebhookMigrated {
+		err = b.setWebhookMigrated()
+	}
+
+	if err != nil {
+		logger.Errorf("restoreWebhook %d: %s", id, err.Error())
+	}
+}
+
+func pollUpdates(id int) error {
+	b := getBotByID(id)
+	if b.ID == 0 {
+		return errBotNotFound
+	}
+
+	bot, err := getBotAPI(b)
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Set("offset", strconv.Itoa(b.UpdateOffset))
+	params.Set("limit", strconv.Itoa(pollingLimit))
+	params.Set("timeout", strconv.Itoa(pollingTimeout))
+
+	resp, err := bot.MakeRequest("getUpdates", params)
+	if err != nil {
+		return err
+	}
+
+	var updates []json.RawMessage
+	if err := json.Unmarshal(resp.Result, &updates); err != nil {
+		return err
+	}
+
+	offset := b.UpdateOffset
+	for _, payload := range updates {
+		var update tgbotapi.Update
+		if err := json.Unmarshal(payload, &update); err != nil {
+			return err
+		}
+
+		if err := enqueueUpdate(*b, payload); err != nil {
+			return err
+		}
+
+		offset = update.UpdateID + 1
+	}
+
+	if offset != b.UpdateOffset {
+		return b.saveUpdateOffset(offset)
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2non/gock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newPollingBot() *Bot {
+	return &Bot{Channel: 9000002, Token: "9000002:Polling", UpdateMode: UpdateModePolling, WebhookID: "hook", WebhookSecret: "secret"}
+}
+
+func TestPolling_getUpdateMode(t *testing.T) {
+	defer func(c *TransportConfig) { config = c }(config)
+
+	config = &TransportConfig{}
+	assert.Equal(t, UpdateModeWebhook, (&Bot{}).getUpdateMode())
+	assert.Equal(t, UpdateModePolling, (&Bot{UpdateMode: UpdateModePolling}).getUpdateMode())
+
+	config = &TransportConfig{UpdateMode: UpdateModePolling}
+	assert.Equal(t, UpdateModePolling, (&Bot{}).getUpdateMode())
+	assert.Equal(t, UpdateModeWebhook, (&Bot{UpdateMode: UpdateModeWebhook}).getUpdateMode())
+}
+
+func TestPolling_deletedBot(t *testing.T) {
+	assert.Equal(t, errBotNotFound, pollUpdates(999999999))
+	assert.Equal(t, errBotNotFound, removeWebhook(999999999))
+
+	done := make(chan struct{})
+	go func() {
+		pollBot(999999999, make(chan struct{}))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("polling of deleted bot is not stopped")
+	}
+}
+
+func TestPolling_webhookIsRemovedAndRestored(t *testing.T) {
+	defer gock.Off()
+
+	b := newPollingBot()
+	createTestBot(t, b)
+	defer deleteTestBot(b)
+
+	gock.New("https://api.telegram.org").
+		Post("/bot9000002:Polling/deleteWebhook").
+		Reply(200).
+		BodyString(`{"ok":true,"result":true}`)
+
+	require.NoError(t, removeWebhook(b.ID))
+
+	// webhook is not set while the bot is still in polling mode
+	restoreWebhook(b.ID)
+	assert.True(t, gock.IsDone())
+
+	b.UpdateMode = UpdateModeWebhook
+	require.NoError(t, b.save())
+
+	gock.New("https://api.telegram.org").
+		Post("/bot9000002:Polling/setWebhook").
+		MatchType("url").
+		BodyString(`secret_token=secret&url=https%3A%2F%2F.+%2Ftelegram%2Fhook`).
+		Reply(200).
+		BodyString(`{"ok":true,"result":true}`)
+
+	restoreWebhook(b.ID)
+	assert.True(t, gock.IsDone())
+}
+
+func TestPolling_pollUpdates(t *testing.T) {
+	defer gock.Off()
+	require.NoError(t, orm.DB.Exec("DELETE FROM inbound_update").Error)
+
+	b := newPollingBot()
+	createTestBot(t, b)
+	defer deleteTestBot(b)
+
+	gock.New("https://api.telegram.org").
+		Post("/bot9000002:Polling/getUpdates").
+		MatchType("url").
+		BodyString(`limit=100&offset=0&timeout=30`).
+		Reply(200).
+		BodyString(`{"ok":true,"result":[{"update_id":10,"message":{"message_id":1,"chat":{"id":100}}}]}`)
+
+	require.NoError(t, pollUpdates(b.ID))
+	assert.True(t, gock.IsDone())
+	assert.Equal(t, 11, getBotByID(b.ID).UpdateOffset)
+}
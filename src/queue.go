@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const (
+	queueStatusPending    = "pending"
+	queueStatusProcessing = "processing"
+	queueStatusDead       = "dead"
+	queueStatusSent       = "sent"
+	// queueStatusDone marks processed inbound updates kept until retention so that redelivered ones are skipped
+	queueStatusDone = "done"
+)
+
+// panicError is returned for queue item which made its handler panic, such items are never retried
+type panicError struct {
+	value interface{}
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.value)
+}
+
+// recoverJob calls fn turning panic into error so that one bad item can not crash the process
+func recoverJob(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errorf("panic: %v\n%s", r, debug.Stack())
+			err = &panicError{value: r}
+		}
+	}()
+
+	return fn()
+}
+
+// Workers is a pool of goroutines polling for jobs until stopped
+type Workers struct {
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newWorkers() *Workers {
+	return &Workers{stop: make(chan struct{})}
+}
+
+// run starts n goroutines calling job until Stop is called.
+// job returns false when there was nothing to do, then the goroutine sleeps for interval.
+func (w *Workers) run(n int, interval time.Duration, job func() bool) {
+	for i := 0; i < n; i++ {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for {
+				select {
+				case <-w.stop:
+					return
+				default:
+				}
+
+				if w.call(job) {
+					continue
+				}
+
+				select {
+				case <-w.stop:
+					return
+				case <-time.After(interval):
+				}
+			}
+		}()
+	}
+}
+
+// call runs job, panic is logged and the worker sleeps as if there was nothing to do
+func (w *Workers) call(job func() bool) (more bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errorf("worker panic: %v\n%s", r, debug.Stack())
+			more = false
+		}
+	}()
+
+	return job()
+}
+
+// Stop signals workers to exit and waits for the running jobs
+func (w *Workers) Stop() {
+	close(w.stop)
+	w.wg.Wait()
+}
+
+// retryDelay returns exponential backoff delay for the given attempt
+func retryDelay(qc QueueConfig, attempt int) time.Duration {
+	delay := time.Duration(qc.RetryDelay) * time.Second
+	max := time.Duration(qc.MaxRetryDelay) * time.Second
+
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+
+	if delay > max {
+		delay = max
+	}
+
+	return delay
+}
+
+// getUpdateChatID returns chat the update belongs to, updates of one chat are processed in order
+func getUpdateChatID(update Update) int64 {
+	switch {
+	case update.Message != nil && update.Message.Chat != nil:
+		return update.Message.Chat.ID
+	case update.EditedMessage != nil && update.EditedMessage.Chat != nil:
+		return update.EditedMessage.Chat.ID
+	case update.CallbackQuery != nil && update.CallbackQuery.Message != nil:
+		return update.CallbackQuery.Message.Chat.ID
+	case update.MyChatMember != nil:
+		return update.MyChatMember.Chat.ID
+	}
+
+	return 0
+}
+
+func enqueueUpdate(b Bot, payload []byte) error {
+	update, err := parseUpdate(payload)
+	if err != nil {
+		return err
+	}
+
+	u := InboundUpdate{
+		BotID:    b.ID,
+		UpdateID: update.UpdateID,
+		ChatID:   getUpdateChatID(update),
+		Payload:  string(payload),
+	}
+
+	return u.enqueue()
+}
+
+func startInboundQueue() *Workers {
+	qc := config.InboundQueue.withDefaults()
+	lockTimeout := time.Duration(qc.LockTimeout) * time.Second
+
+	w := newWorkers()
+	w.run(qc.Workers, time.Duration(qc.PollInterval)*time.Second, func() bool {
+		return processInboundUpdate(qc)
+	})
+	w.run(1, lockTimeout, func() bool {
+		if err := releaseStaleQueued("inbound_update", time.Now().Add(-lockTimeout)); err != nil {
+			logger.Error("releaseStaleQueued inbound_update:", err)
+		}
+
+		if err := deleteFinishedQueued("inbound_update", queueStatusDone, time.Now().Add(-qc.getRetention())); err != nil {
+			logger.Error("deleteFinishedQueued inbound_update:", err)
+		}
+
+		return false
+	})
+
+	return w
+}
+
+func processInboundUpdate(qc QueueConfig) bool {
+	u, err := claimInboundUpdate()
+	if err != nil {
+		logger.Error("claimInboundUpdate:", err)
+		return false
+	}
+
+	if u == nil {
+		return false
+	}
+
+	err = recoverJob(func() error {
+		return handleInboundUpdate(u)
+	})
+	if err == nil {
+		if err = u.complete(); err != nil {
+			logger.Errorf("inbound update %d: complete: %s", u.ID, err.Error())
+		}
+
+		return true
+	}
+
+	if _, panicked := err.(*panicError); panicked || u.Attempts >= qc.MaxAttempts {
+		logger.Errorf("inbound update %d: giving up after %d attempts: %s", u.ID, u.Attempts, err.Error())
+		err = u.bury(err)
+	} else {
+		logger.Warningf("inbound update %d: attempt %d failed: %s", u.ID, u.Attempts, err.Error())
+		err = u.retry(err, time.Now().Add(retryDelay(qc, u.Attempts)))
+	}
+
+	if err != nil {
+		logger.Errorf("inbound update %d: %s", u.ID, err.Error())
+	}
+
+	return true
+}
+
+func handleInboundUpdate(u *InboundUpdate) error {
+	update, err := parseUpdate([]byte(u.Payload))
+	if err != nil {
+		return err
+	}
+
+	b := getBotByID(u.BotID)
+	if b.ID == 0 {
+		return errors.New(fmt.Sprintf("bot %d not found", u.BotID))
+	}
+
+	return processUpdate(*b, update)
+}
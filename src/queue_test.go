@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createQueueBot adds bot the queue rows refer to, the queue is emptied so that only rows of the test are claimed
+func createQueueBot(t *testing.T, table string) *Bot {
+	require.NoError(t, orm.DB.Exec("DELETE FROM "+table).Error)
+
+	b := &Bot{Channel: 9000001, Token: "9000001:Queue"}
+	createTestBot(t, b)
+
+	return b
+}
+
+func enqueueTestUpdate(t *testing.T, b *Bot, updateID int, chatID int64) {
+	u := InboundUpdate{BotID: b.ID, UpdateID: updateID, ChatID: chatID, Payload: `{"update_id":1}`}
+	require.NoError(t, u.enqueue())
+}
+
+func claimTestUpdate(t *testing.T) *InboundUpdate {
+	u, err := claimInboundUpdate()
+	require.NoError(t, err)
+
+	return u
+}
+
+func TestQueue_claimInChatOrder(t *testing.T) {
+	b := createQueueBot(t, "inbound_update")
+	defer deleteTestBot(b)
+
+	enqueueTestUpdate(t, b, 1, 100)
+	enqueueTestUpdate(t, b, 2, 100)
+	enqueueTestUpdate(t, b, 3, 200)
+
+	first := claimTestUpdate(t)
+	require.NotNil(t, first)
+	assert.Equal(t, 1, first.UpdateID)
+	assert.Equal(t, 1, first.Attempts)
+	assert.Equal(t, queueStatusProcessing, first.Status)
+
+	// the second update of the chat waits for the first one
+	other := claimTestUpdate(t)
+	require.NotNil(t, other)
+	assert.Equal(t, 3, other.UpdateID)
+	assert.Nil(t, claimTestUpdate(t))
+
+	require.NoError(t, first.complete())
+	second := claimTestUpdate(t)
+	require.NotNil(t, second)
+	assert.Equal(t, 2, second.UpdateID)
+}
+
+func TestQueue_retryAndBury(t *testing.T) {
+	b := createQueueBot(t, "inbound_update")
+	defer deleteTestBot(b)
+
+	enqueueTestUpdate(t, b, 1, 100)
+	enqueueTestUpdate(t, b, 2, 100)
+
+	u := claimTestUpdate(t)
+	require.NotNil(t, u)
+	require.NoError(t, u.retry(errors.New("failed"), time.Now().Add(time.Hour)))
+
+	// postponed update keeps later updates of the chat waiting
+	assert.Nil(t, claimTestUpdate(t))
+
+	require.NoError(t, u.retry(errors.New("failed"), time.Now().Add(-time.Second)))
+	u = claimTestUpdate(t)
+	require.NotNil(t, u)
+	assert.Equal(t, 1, u.UpdateID)
+	assert.Equal(t, 2, u.Attempts)
+
+	require.NoError(t, u.bury(errors.New("failed")))
+	next := claimTestUpdate(t)
+	require.NotNil(t, next)
+	assert.Equal(t, 2, next.UpdateID)
+
+	var dead InboundUpdate
+	require.NoError(t, orm.DB.First(&dead, u.ID).Error)
+	assert.Equal(t, queueStatusDead, dead.Status)
+	assert.Equal(t, "failed", dead.LastError)
+}
+
+func TestQueue_releaseStale(t *testing.T) {
+	b := createQueueBot(t, "inbound_update")
+	defer deleteTestBot(b)
+
+	enqueueTestUpdate(t, b, 1, 100)
+
+	require.NotNil(t, claimTestUpdate(t))
+	assert.Nil(t, claimTestUpdate(t))
+
+	require.NoError(t, releaseStaleQueued("inbound_update", time.Now().Add(-time.Hour)))
+	assert.Nil(t, claimTestUpdate(t))
+
+	require.NoError(t, releaseStaleQueued("inbound_update", time.Now().Add(time.Second)))
+	u := claimTestUpdate(t)
+	require.NotNil(t, u)
+	assert.Equal(t, 2, u.Attempts)
+}
+
+func TestQueue_completedUpdateIsNotEnqueuedAgain(t *testing.T) {
+	b := createQueueBot(t, "inbound_update")
+	defer deleteTestBot(b)
+
+	enqueueTestUpdate(t, b, 1, 100)
+	u := claimTestUpdate(t)
+	require.NotNil(t, u)
+	require.NoError(t, u.complete())
+
+	enqueueTestUpdate(t, b, 1, 100)
+	assert.Nil(t, claimTestUpdate(t))
+
+	require.NoError(t, deleteFinishedQueued("inbound_update", queueStatusDone, time.Now().Add(time.Second)))
+	enqueueTestUpdate(t, b, 1, 100)
+	assert.NotNil(t, claimTestUpdate(t))
+}
+
+func TestQueue_recoverJob(t *testing.T) {
+	err := recoverJob(func() error {
+		var items *[]int
+		_ = *items
+
+		return nil
+	})
+
+	_, ok := err.(*panicError)
+	assert.True(t, ok)
+
+	retry, _ := retryableSendError(err)
+	assert.False(t, retry)
+
+	assert.EqualError(t, recoverJob(func() error { return errors.New("failed") }), "failed")
+}
+
+func TestQueue_workersSurvivePanic(t *testing.T) {
+	calls := make(chan struct{}, 2)
+
+	w := newWorkers()
+	w.run(1, time.Millisecond, func() bool {
+		select {
+		case calls <- struct{}{}:
+		default:
+		}
+
+		panic("job failed")
+	})
+
+	<-calls
+	<-calls
+	w.Stop()
+}
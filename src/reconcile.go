@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	v1 "github.com/retailcrm/mg-transport-api-client-go/v1"
+)
+
+const (
+	// advisory lock namespace guarding reconciliation of a connection across replicas
+	reconcileLockNamespace int32 = 2
+
+	defaultReconcileInterval = 24
+	defaultReconcileRate     = 5
+	reconcileCheckInterval   = time.Minute
+	// reconcileChannelGrace keeps channels activated recently, their bot may be not saved yet
+	reconcileChannelGrace = 10 * time.Minute
+)
+
+func init() {
+	parser.AddCommand("reconcile",
+		"Reconcile MG channels with bots",
+		"Update settings of MG channels of the bots and deactivate channels without bots.",
+		&ReconcileCommand{},
+	)
+}
+
+// ReconcileCommand struct
+type ReconcileCommand struct {
+	ClientID string `short:"i" long:"client-id" default:"" description:"Reconcile only the connection with the client ID."`
+	DryRun   bool   `short:"n" long:"dry-run" description:"Show changes without making them."`
+}
+
+// Execute method
+func (x *ReconcileCommand) Execute(args []string) error {
+	config = LoadConfig(options.Config)
+	orm = NewDb(config)
+	logger = newLogger()
+	defer orm.Close()
+
+	hash, err := getChannelSettingsHash()
+	if err != nil {
+		return err
+	}
+
+	connections := getConnections()
+	if x.ClientID != "" {
+		conn := getConnection(x.ClientID)
+		if conn.ID == 0 {
+			return fmt.Errorf("connection %s not found", x.ClientID)
+		}
+
+		connections = []*Connection{conn}
+	}
+
+	opts := reconcileOptions{DryRun: x.DryRun, Force: true}
+	for _, conn := range connections {
+		res, err := reconcileConnection(conn.ID, hash, opts)
+		if err != nil {
+			fmt.Printf("%s: %s\n", conn.ClientID, err.Error())
+			continue
+		}
+
+		res.print(conn, x.DryRun)
+	}
+
+	return nil
+}
+
+// reconcileOptions tell how connection is reconciled, Force skips the check whether it is due
+type reconcileOptions struct {
+	DryRun bool
+	Force  bool
+}
+
+// reconcileResult lists channels updated and deactivated or, in dry run, which would be
+type reconcileResult struct {
+	Updated     []uint64
+	Deactivated []uint64
+	Inactive    bool
+	Locked      bool
+	Skipped     bool
+}
+
+func (r reconcileResult) print(conn *Connection, dryRun bool) {
+	switch {
+	case r.Inactive:
+		fmt.Printf("%s: connection is not active, skipped\n", conn.ClientID)
+	case r.Locked:
+		fmt.Printf("%s: reconciled by another process, skipped\n", conn.ClientID)
+	case dryRun:
+		fmt.Printf("%s: would update channels %v, would deactivate channels %v\n", conn.ClientID, r.Updated, r.Deactivated)
+	default:
+		fmt.Printf("%s: updated channels %v, deactivated channels %v\n", conn.ClientID, r.Updated, r.Deactivated)
+	}
+}
+
+func getReconcileInterval() time.Duration {
+	if config.Reconcile.Interval > 0 {
+		return time.Duration(config.Reconcile.Interval) * time.Hour
+	}
+
+	return defaultReconcileInterval * time.Hour
+}
+
+// getReconcileRequestDelay returns delay between MG requests made for one connection
+func getReconcileRequestDelay() time.Duration {
+	rate := config.Reconcile.Rate
+	if rate <= 0 {
+		rate = defaultReconcileRate
+	}
+
+	return time.Duration(float64(time.Second) / rate)
+}
+
+// isReconcileDue returns true if channel settings changed or the connection was not reconciled for the interval
+func (c *Connection) isReconcileDue(hash string, now time.Time) bool {
+	return c.ReconciledHash != hash || c.ReconciledAt == nil || now.Sub(*c.ReconciledAt) >= getReconcileInterval()
+}
+
+// startReconciliation reconciles due connections in background, every connection is reconciled
+// by one replica at a time and replicas skip connections just reconciled by another one
+func startReconciliation() *Workers {
+	w := newWorkers()
+
+	w.run(1, reconcileCheckInterval, func() bool {
+		hash, err := getChannelSettingsHash()
+		if err != nil {
+			logger.Error("reconcile:", err)
+			return false
+		}
+
+		now := time.Now()
+		for _, conn := range getConnections() {
+			select {
+			case <-w.stop:
+				return false
+			default:
+			}
+
+			if !conn.Active || !conn.isReconcileDue(hash, now) {
+				continue
+			}
+
+			if _, err := reconcileConnection(conn.ID, hash, reconcileOptions{}); err != nil {
+				logger.Errorf("reconcile connection %d: %s", conn.ID, err.Error())
+			}
+		}
+
+		return false
+	})
+
+	return w
+}
+
+// reconcileConnection updates settings of MG channels of the bots and deactivates active channels
+// which have no bot, requests to MG are spaced out by the configured rate
+func reconcileConnection(id int, hash string, opts reconcileOptions) (reconcileResult, error) {
+	var res reconcileResult
+
+	lock, err := orm.tryAdvisoryLock(reconcileLockNamespace, int32(id))
+	if err != nil {
+		return res, err
+	}
+
+	if lock == nil {
+		res.Locked = true
+		return res, nil
+	}
+	defer lock.Release()
+
+	// connection is read under the lock so that it is not reconciled twice in a row
+	conn := getConnectionById(id)
+	if !conn.Active {
+		res.Inactive = true
+		return res, nil
+	}
+
+	if !opts.Force && !conn.isReconcileDue(hash, time.Now()) {
+		res.Skipped = true
+		return res, nil
+	}
+
+	// channels are never deactivated all at once, connection without bots is left as it is
+	bots := conn.getBotsByClientID()
+	if len(bots) == 0 {
+		if opts.DryRun {
+			return res, nil
+		}
+
+		return res, conn.setReconciled(hash)
+	}
+
+	client := getMGClient(conn)
+	limiter := time.NewTicker(getReconcileRequestDelay())
+	defer limiter.Stop()
+
+	var channelIDs []uint64
+	for _, bot := range bots {
+		channelIDs = append(channelIDs, bot.Channel)
+		if bot.ChannelSettingsHash == hash {
+			continue
+		}
+
+		res.Updated = append(res.Updated, bot.Channel)
+		if opts.DryRun {
+			continue
+		}
+
+		channelSettings := getChannelSettings(bot.Channel)
+		if bot.Name != "" {
+			channelSettings.Name = "@" + bot.Name
+		}
+
+		<-limiter.C
+		data, status, err := updateTransportChannel(client, channelSettings)
+		if config.Debug {
+			logger.Debugf(
+				"reconcile apiURL: %s, ChannelID: %d, Data: %v, Status: %d, err: %v",
+				conn.APIURL, bot.Channel, data, status, err,
+			)
+		}
+
+		if err != nil {
+			logger.Errorf("reconcile apiURL: %s, ChannelID: %d, err: %s", conn.APIURL, bot.Channel, err.Error())
+			continue
+		}
+
+		bot.ChannelSettingsHash = hash
+		if err := bot.save(); err != nil {
+			logger.Errorf("reconcile bot.save apiURL: %s, ChannelID: %d, err: %s", conn.APIURL, bot.Channel, err.Error())
+		}
+	}
+
+	<-limiter.C
+	channels, status, err := client.TransportChannels(v1.Channels{Active: true})
+	if config.Debug {
+		logger.Debugf("TransportChannels ChannelListItems: %+v, Status: %d, err: %v", channels, status, err)
+	}
+
+	if err != nil {
+		return res, err
+	}
+
+	for _, chID := range getStaleChannels(channels, channelIDs, time.Now()) {
+		res.Deactivated = append(res.Deactivated, chID)
+		if opts.DryRun {
+			continue
+		}
+
+		<-limiter.C
+		_, status, err := client.DeactivateTransportChannel(chID)
+		if config.Debug {
+			logger.Debugf("DeactivateTransportChannel ChannelID: %d, Status: %d, err: %v", chID, status, err)
+		}
+
+		if err != nil {
+			logger.Errorf("reconcile apiURL: %s, deactivate ChannelID: %d, err: %s", conn.APIURL, chID, err.Error())
+		}
+	}
+
+	if opts.DryRun {
+		return res, nil
+	}
+
+	return res, conn.setReconciled(hash)
+}
+
+// getStaleChannels returns active channels which do not belong to any bot,
+// channels activated during the grace period are kept as their bot may be being added
+func getStaleChannels(channels []v1.ChannelListItem, channelIDs []uint64, now time.Time) []uint64 {
+	known := map[uint64]bool{}
+	for _, id := range channelIDs {
+		known[id] = true
+	}
+
+	var stale []uint64
+	for _, ch := range channels {
+		if known[ch.ID] {
+			continue
+		}
+
+		if activatedAt, err := time.Parse(time.RFC3339, ch.ActivatedAt); err == nil && now.Sub(activatedAt) < reconcileChannelGrace {
+			continue
+		}
+
+		stale = append(stale, ch.ID)
+	}
+
+	return stale
+}
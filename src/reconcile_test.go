@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	v1 "github.com/retailcrm/mg-transport-api-client-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconcile_getStaleChannels(t *testing.T) {
+	now := time.Date(2020, 5, 20, 12, 0, 0, 0, time.UTC)
+	channels := []v1.ChannelListItem{
+		{ID: 1, ActivatedAt: "2020-05-01T10:00:00+00:00"},
+		{ID: 2, ActivatedAt: "2020-05-01T10:00:00+00:00"},
+		{ID: 3, ActivatedAt: "2020-05-20T11:55:00+00:00"},
+		{ID: 4},
+	}
+
+	assert.Equal(t, []uint64{2, 4}, getStaleChannels(channels, []uint64{1}, now))
+	assert.Empty(t, getStaleChannels(channels[:1], []uint64{1}, now))
+}
+
+func TestReconcile_isReconcileDue(t *testing.T) {
+	defer func(c *TransportConfig) { config = c }(config)
+	config = &TransportConfig{Reconcile: ReconcileConfig{Interval: 1, Rate: 2}}
+
+	now := time.Now()
+	recent := now.Add(-time.Minute)
+	old := now.Add(-2 * time.Hour)
+
+	assert.True(t, (&Connection{}).isReconcileDue("hash", now))
+	assert.True(t, (&Connection{ReconciledAt: &recent, ReconciledHash: "old"}).isReconcileDue("hash", now))
+	assert.True(t, (&Connection{ReconciledAt: &old, ReconciledHash: "hash"}).isReconcileDue("hash", now))
+	assert.False(t, (&Connection{ReconciledAt: &recent, ReconciledHash: "hash"}).isReconcileDue("hash", now))
+
+	assert.Equal(t, 500*time.Millisecond, getReconcileRequestDelay())
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"time"
 
 	"github.com/jinzhu/gorm"
@@ -28,7 +29,10 @@ func getConnectionByURL(urlCrm string) *Connection {
 }
 
 func (c *Connection) setConnectionActivity() error {
-	return orm.DB.Model(c).Where("client_id = ?", c.ClientID).Update("Active", c.Active).Error
+	err := orm.DB.Model(c).Where("client_id = ?", c.ClientID).Update("Active", c.Active).Error
+	c.invalidate()
+
+	return err
 }
 
 func (c *Connection) createConnection() error {
@@ -36,40 +40,77 @@ func (c *Connection) createConnection() error {
 }
 
 func (c *Connection) saveConnection() error {
-	return orm.DB.Save(c).Error
+	err := orm.DB.Save(c).Error
+	c.invalidate()
+
+	return err
 }
 
 func (c *Connection) saveConnectionByClientID() error {
-	return orm.DB.Model(c).Where("client_id = ?", c.ClientID).Update(c).Error
+	err := orm.DB.Model(c).Where("client_id = ?", c.ClientID).Update(c).Error
+	c.invalidate()
+
+	return err
+}
+
+// invalidate drops cached copies of the connection after it was changed
+func (c *Connection) invalidate() {
+	id := c.ID
+	if id == 0 {
+		id = getConnection(c.ClientID).ID
+	}
+
+	invalidateConnection(id)
+}
+
+// setReconciled remembers MG channels of the connection were reconciled with the settings of the hash
+func (c *Connection) setReconciled(hash string) error {
+	return orm.DB.Model(c).UpdateColumns(map[string]interface{}{
+		"reconciled_at":   time.Now(),
+		"reconciled_hash": hash,
+	}).Error
+}
+
+func (c *Connection) setModuleHash(hash string) error {
+	c.ModuleHash = hash
+	return orm.DB.Model(c).UpdateColumn("module_hash", hash).Error
 }
 
 func (c *Connection) createBot(b Bot) error {
 	return orm.DB.Model(c).Association("Bots").Append(&b).Error
 }
 
-func getBotByToken(token string) (*Bot, error) {
+func getBotByToken(token EncryptedString) (*Bot, error) {
 	var bot Bot
-	err := orm.DB.First(&bot, "token = ?", token).Error
+	err := orm.DB.First(&bot, "token_hash = ?", secretHash(string(token))).Error
 	if gorm.IsRecordNotFoundError(err) {
 		return &bot, nil
-	} else {
-		return &bot, err
 	}
 
-	return &bot, nil
+	return &bot, err
+}
+
+func getBotByWebhookID(id string) *Bot {
+	var bot Bot
+	orm.DB.First(&bot, "webhook_id = ?", id)
+
+	return &bot
 }
 
 func (b *Bot) save() error {
-	return orm.DB.Save(b).Error
+	err := orm.DB.Save(b).Error
+	invalidateBot(b.ID, b.ConnectionID)
+
+	return err
 }
 
 func (b *Bot) deleteBot() error {
-	return orm.DB.Delete(b, "token = ?", b.Token).Error
+	return orm.DB.Delete(b, "token_hash = ?", secretHash(string(b.Token))).Error
 }
 
-func getBotChannelByToken(token string) uint64 {
+func getBotChannelByToken(token EncryptedString) uint64 {
 	var b Bot
-	orm.DB.First(&b, "token = ?", token)
+	orm.DB.First(&b, "token_hash = ?", secretHash(string(token)))
 
 	return b.Channel
 }
@@ -122,3 +163,271 @@ func getUserByExternalID(eid int) *User {
 func (u *User) Expired(updateInterval int) bool {
 	return time.Now().After(u.UpdatedAt.Add(time.Hour * time.Duration(updateInterval)))
 }
+
+func getBotByID(id int) *Bot {
+	var bot Bot
+	orm.DB.First(&bot, "id = ?", id)
+
+	return &bot
+}
+
+func (u *InboundUpdate) enqueue() error {
+	return orm.DB.Exec(
+		"INSERT INTO inbound_update (bot_id, update_id, chat_id, payload, status) "+
+			"VALUES (?, ?, ?, ?, ?) "+
+			"ON CONFLICT (bot_id, update_id) DO NOTHING",
+		u.BotID,
+		u.UpdateID,
+		u.ChatID,
+		u.Payload,
+		queueStatusPending,
+	).Error
+}
+
+// claimQueued locks the oldest due item of a chat which has no earlier unfinished items in the queue table
+func claimQueued(table string, dest interface{}) (bool, error) {
+	err := orm.DB.Raw(
+		"UPDATE "+table+" SET status = ?, attempts = attempts + 1, locked_at = ?, updated_at = ? "+
+			"WHERE id = ("+
+			"SELECT q.id FROM "+table+" q "+
+			"WHERE q.status = ? AND q.next_attempt_at <= ? "+
+			"AND NOT EXISTS ("+
+			"SELECT 1 FROM "+table+" p "+
+			"WHERE p.bot_id = q.bot_id AND p.chat_id = q.chat_id AND p.id < q.id AND p.status IN (?, ?)"+
+			") "+
+			"ORDER BY q.id LIMIT 1 FOR UPDATE SKIP LOCKED"+
+			") RETURNING *",
+		queueStatusProcessing,
+		time.Now(),
+		time.Now(),
+		queueStatusPending,
+		time.Now(),
+		queueStatusPending,
+		queueStatusProcessing,
+	).Scan(dest).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// releaseStaleQueued returns to the queue table items locked by a crashed worker
+func releaseStaleQueued(table string, lockedBefore time.Time) error {
+	return orm.DB.Exec(
+		"UPDATE "+table+" SET status = ?, locked_at = NULL WHERE status = ? AND locked_at < ?",
+		queueStatusPending,
+		queueStatusProcessing,
+		lockedBefore,
+	).Error
+}
+
+// deleteFinishedQueued removes items of the queue table finished before the given time
+func deleteFinishedQueued(table, status string, finishedBefore time.Time) error {
+	return orm.DB.Exec(
+		"DELETE FROM "+table+" WHERE status = ? AND updated_at < ?",
+		status,
+		finishedBefore,
+	).Error
+}
+
+func claimInboundUpdate() (*InboundUpdate, error) {
+	var u InboundUpdate
+	ok, err := claimQueued("inbound_update", &u)
+	if !ok {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+// complete marks update processed, the row is kept until retention so that redelivered update is not enqueued again
+func (u *InboundUpdate) complete() error {
+	return orm.DB.Model(u).Updates(map[string]interface{}{
+		"status":    queueStatusDone,
+		"payload":   "",
+		"locked_at": nil,
+	}).Error
+}
+
+func (u *InboundUpdate) retry(reason error, at time.Time) error {
+	return orm.DB.Model(u).Updates(map[string]interface{}{
+		"status":          queueStatusPending,
+		"last_error":      reason.Error(),
+		"next_attempt_at": at,
+		"locked_at":       nil,
+	}).Error
+}
+
+func (u *InboundUpdate) bury(reason error) error {
+	return orm.DB.Model(u).Updates(map[string]interface{}{
+		"status":     queueStatusDead,
+		"last_error": reason.Error(),
+		"locked_at":  nil,
+	}).Error
+}
+
+func (m *OutboundMessage) enqueue() error {
+	m.Status = queueStatusPending
+	m.NextAttemptAt = time.Now()
+
+	return orm.DB.Create(m).Error
+}
+
+func claimOutboundMessage() (*OutboundMessage, error) {
+	var m OutboundMessage
+	ok, err := claimQueued("outbound_message", &m)
+	if !ok {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+func (m *OutboundMessage) sent(messageID int) error {
+	return orm.DB.Model(m).Updates(map[string]interface{}{
+		"status":     queueStatusSent,
+		"message_id": messageID,
+		"locked_at":  nil,
+	}).Error
+}
+
+func (m *OutboundMessage) retry(reason error, at time.Time) error {
+	return orm.DB.Model(m).Updates(map[string]interface{}{
+		"status":          queueStatusPending,
+		"last_error":      reason.Error(),
+		"next_attempt_at": at,
+		"locked_at":       nil,
+	}).Error
+}
+
+func (m *OutboundMessage) bury(reason error) error {
+	return orm.DB.Model(m).Updates(map[string]interface{}{
+		"status":     queueStatusDead,
+		"last_error": reason.Error(),
+		"locked_at":  nil,
+	}).Error
+}
+
+func getOutboundMessage(id int) *OutboundMessage {
+	var m OutboundMessage
+	orm.DB.First(&m, "id = ?", id)
+
+	return &m
+}
+
+// hasQueuedOutboundMessages returns true if chat has messages waiting for delivery
+func hasQueuedOutboundMessages(botID int, chatID int64) bool {
+	var count int
+	orm.DB.Model(&OutboundMessage{}).
+		Where("bot_id = ? AND chat_id = ? AND status IN (?, ?)", botID, chatID, queueStatusPending, queueStatusProcessing).
+		Count(&count)
+
+	return count > 0
+}
+
+func getBots() Bots {
+	var b Bots
+	orm.DB.Find(&b)
+
+	return b
+}
+
+// getBotsWithLegacyWebhook returns bots whose webhook may still point to the URL with token
+func getBotsWithLegacyWebhook() Bots {
+	var b Bots
+	orm.DB.Where("webhook_migrated = ?", false).Find(&b)
+
+	return b
+}
+
+func (b *Bot) setWebhookMigrated() error {
+	b.WebhookMigrated = true
+	return orm.DB.Model(b).UpdateColumn("webhook_migrated", true).Error
+}
+
+func (b *Bot) saveUpdateOffset(offset int) error {
+	return orm.DB.Model(b).UpdateColumn("update_offset", offset).Error
+}
+
+func (m *MessageMap) save() error {
+	return orm.DB.Exec(
+		"INSERT INTO message_map (bot_id, chat_id, message_id, external_id, mg_message_id, part, direction, kind, file_id) "+
+			"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) "+
+			"ON CONFLICT (bot_id, chat_id, external_id, part) DO UPDATE SET "+
+			"message_id = excluded.message_id, mg_message_id = coalesce(excluded.mg_message_id, message_map.mg_message_id), "+
+			"kind = coalesce(excluded.kind, message_map.kind), file_id = excluded.file_id",
+		m.BotID, m.ChatID, m.MessageID, m.ExternalID, sql.NullInt64{Int64: m.MGMessageID, Valid: m.MGMessageID != 0}, m.Part, m.Direction,
+		sql.NullString{String: m.Kind, Valid: m.Kind != ""}, m.FileID,
+	).Error
+}
+
+// getMessageMaps returns Telegram messages of MG message ordered by part
+func getMessageMaps(botID int, chatID int64, externalID string) []MessageMap {
+	var maps []MessageMap
+	orm.DB.Where("bot_id = ? AND chat_id = ? AND external_id = ?", botID, chatID, externalID).Order("part").Find(&maps)
+
+	return maps
+}
+
+// getMessageMapByMessageID returns mapping of Telegram message, ID is zero if message is unknown
+func getMessageMapByMessageID(botID int, chatID int64, messageID int) *MessageMap {
+	var m MessageMap
+	orm.DB.Where("bot_id = ? AND chat_id = ? AND message_id = ?", botID, chatID, messageID).First(&m)
+
+	return &m
+}
+
+// getLastMessageMap returns mapping of the latest message in the chat, ID is zero if there are none
+func getLastMessageMap(botID int, chatID int64) *MessageMap {
+	var m MessageMap
+	orm.DB.Where("bot_id = ? AND chat_id = ?", botID, chatID).Order("id desc").First(&m)
+
+	return &m
+}
+
+// setRead remembers MG knows the message is read
+func (m *MessageMap) setRead() error {
+	m.Read = true
+
+	return orm.DB.Model(m).UpdateColumn("read", true).Error
+}
+
+func deleteMessageMaps(botID int, chatID int64, externalID string, fromPart int) error {
+	return orm.DB.Where(
+		"bot_id = ? AND chat_id = ? AND external_id = ? AND part >= ?", botID, chatID, externalID, fromPart,
+	).Delete(MessageMap{}).Error
+}
+
+// isChatBlocked returns true if the bot was blocked by customer or removed from the chat
+func isChatBlocked(botID int, chatID int64) bool {
+	var st ChatState
+	orm.DB.Where("bot_id = ? AND chat_id = ?", botID, chatID).First(&st)
+
+	return st.Blocked
+}
+
+func setChatBlocked(botID int, chatID int64, blocked bool) error {
+	return orm.DB.Exec(
+		"INSERT INTO chat_state (bot_id, chat_id, blocked) VALUES (?, ?, ?) "+
+			"ON CONFLICT (bot_id, chat_id) DO UPDATE SET blocked = excluded.blocked, updated_at = current_timestamp",
+		botID, chatID, blocked,
+	).Error
+}
+
+// getCRMCustomer returns retailCRM customer linked to Telegram user, ID is zero if there is none
+func getCRMCustomer(connectionID, userExternalID int) *CRMCustomer {
+	var c CRMCustomer
+	orm.DB.Where("connection_id = ? AND user_external_id = ?", connectionID, userExternalID).First(&c)
+
+	return &c
+}
+
+func (c *CRMCustomer) save() error {
+	return orm.DB.Exec(
+		"INSERT INTO crm_customer (connection_id, user_external_id, customer_id) VALUES (?, ?, ?) "+
+			"ON CONFLICT (connection_id, user_external_id) DO UPDATE SET "+
+			"customer_id = excluded.customer_id, updated_at = current_timestamp",
+		c.ConnectionID, c.UserExternalID, c.CustomerID,
+	).Error
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+)
+
+func init() {
+	parser.AddCommand("rotate-keys",
+		"Re-encrypt bot tokens and API keys with the current encryption key",
+		"Re-encrypt bot tokens and API keys with the current encryption key.",
+		&RotateKeysCommand{},
+	)
+}
+
+// RotateKeysCommand struct
+type RotateKeysCommand struct{}
+
+// Execute method
+func (x *RotateKeysCommand) Execute(args []string) error {
+	config = LoadConfig(options.Config)
+	orm = NewDb(config)
+	logger = newLogger()
+	defer orm.Close()
+
+	if config.Encryption.CurrentKey == "" {
+		fmt.Println("Current encryption key is not configured, secrets will be stored as plain text")
+	}
+
+	count, err := encryptSecrets(true)
+	fmt.Printf("Re-encrypted secrets of %d records\n", count)
+
+	return err
+}
+
+// encryptSecrets writes secrets with the current key, when all is false only records
+// with plain text secrets or without lookup hash are processed. Without the current key
+// secrets stay plain and only lookup hash is filled for bots added before it appeared
+func encryptSecrets(all bool) (int, error) {
+	var (
+		connections []Connection
+		bots        Bots
+		count       int
+	)
+
+	encrypt := all || config.Encryption.CurrentKey != ""
+	connQuery := orm.DB
+	botQuery := orm.DB
+	if !all {
+		connQuery = connQuery.Where("api_key NOT LIKE ? OR mg_token NOT LIKE ?", encryptedPrefix+"%", encryptedPrefix+"%")
+		botQuery = botQuery.Where("token NOT LIKE ? OR token_hash IS NULL", encryptedPrefix+"%")
+	}
+
+	if !encrypt {
+		botQuery = orm.DB.Where("token_hash IS NULL")
+	} else if err := connQuery.Find(&connections).Error; err != nil {
+		return count, err
+	}
+
+	for _, c := range connections {
+		err := orm.DB.Model(&c).UpdateColumns(map[string]interface{}{
+			"api_key":  c.APIKEY,
+			"mg_token": c.MGToken,
+		}).Error
+		if err != nil {
+			return count, err
+		}
+
+		count++
+	}
+
+	if err := botQuery.Find(&bots).Error; err != nil {
+		return count, err
+	}
+
+	for _, b := range bots {
+		err := orm.DB.Model(&b).UpdateColumns(map[string]interface{}{
+			"token":      b.Token,
+			"token_hash": secretHash(string(b.Token)),
+		}).Error
+		if err != nil {
+			return count, err
+		}
+
+		count++
+	}
+
+	return count, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotate_encryptSecrets_LegacyBot(t *testing.T) {
+	defer func(c *TransportConfig) { config = c }(config)
+	plain := *config
+	plain.Encryption = EncryptionConfig{}
+	config = &plain
+	defer withEncryptionKeys(t, EncryptionConfig{})()
+
+	b := &Bot{Channel: 9000004, Token: "9000004:Legacy"}
+	createTestBot(t, b)
+	defer deleteTestBot(b)
+
+	// bot saved before lookup hash appeared
+	require.NoError(t, orm.DB.Exec("UPDATE bot SET token = ?, token_hash = NULL WHERE id = ?", "9000004:Legacy", b.ID).Error)
+
+	found, err := getBotByToken("9000004:Legacy")
+	require.NoError(t, err)
+	assert.Equal(t, 0, found.ID)
+
+	count, err := encryptSecrets(false)
+	require.NoError(t, err)
+	assert.True(t, count > 0)
+
+	found, err = getBotByToken("9000004:Legacy")
+	require.NoError(t, err)
+	assert.Equal(t, b.ID, found.ID)
+	assert.Equal(t, EncryptedString("9000004:Legacy"), found.Token)
+
+	// nothing is left without hash
+	count, err = encryptSecrets(false)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
@@ -1,13 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"image/png"
 	"io"
-	"io/ioutil"
 	"net/http"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -18,7 +18,6 @@ import (
 	filetypes "github.com/h2non/filetype/matchers"
 	v5 "github.com/retailcrm/api-client-go/v5"
 	v1 "github.com/retailcrm/mg-transport-api-client-go/v1"
-	"golang.org/x/image/webp"
 )
 
 func connectHandler(c *gin.Context) {
@@ -48,7 +47,8 @@ func addBotHandler(c *gin.Context) {
 		return
 	}
 
-	bot, err := tgbotapi.NewBotAPI(b.Token)
+	// the bot is not saved yet so its client is not kept in the registry
+	bot, err := tgbotapi.NewBotAPI(string(b.Token))
 	if err != nil {
 		c.AbortWithStatusJSON(BadRequest("incorrect_token"))
 		logger.Error(b.Token, err.Error())
@@ -57,16 +57,31 @@ func addBotHandler(c *gin.Context) {
 
 	bot.Debug = config.Debug
 
-	wr, err := bot.SetWebhook(tgbotapi.NewWebhook("https://" + config.HTTPServer.Host + "/telegram/" + bot.Token))
+	if !isValidUpdateMode(b.UpdateMode) || !isValidGroupMode(b.GroupMode) {
+		c.AbortWithStatusJSON(BadRequest("wrong_data"))
+		return
+	}
+
+	b.WebhookID = GenerateToken()
+	b.WebhookSecret = GenerateToken()
+	b.WebhookMigrated = true
+
+	var wr tgbotapi.APIResponse
+	if b.getUpdateMode() == UpdateModePolling {
+		wr, err = bot.RemoveWebhook()
+	} else {
+		wr, err = setWebhook(bot, &b)
+	}
+
 	if err != nil || !wr.Ok {
 		c.AbortWithStatusJSON(BadRequest("error_creating_webhook"))
-		logger.Error(b.Token, err.Error(), wr)
+		logger.Error(b.Token, err, wr)
 		return
 	}
 
 	b.Name = bot.Self.UserName
 	conn := getConnectionById(b.ConnectionID)
-	client := v1.New(conn.MGURL, conn.MGToken)
+	client := v1.New(conn.MGURL, string(conn.MGToken))
 	client.Debug = config.Debug
 
 	channelSettings := getChannelSettings()
@@ -74,7 +89,7 @@ func addBotHandler(c *gin.Context) {
 		channelSettings.Name = "@" + b.Name
 	}
 
-	data, status, err := client.ActivateTransportChannel(channelSettings)
+	data, status, err := activateTransportChannel(client, channelSettings)
 	if status != http.StatusCreated {
 		c.AbortWithStatusJSON(BadRequest("error_activating_channel"))
 		logger.Error(conn.APIURL, status, err.Error(), data)
@@ -104,13 +119,24 @@ func addBotHandler(c *gin.Context) {
 
 func deleteBotHandler(c *gin.Context) {
 	b := c.MustGet("bot").(Bot)
+	cl, err := getBotByToken(b.Token)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if cl.ID == 0 || cl.ConnectionID != b.ConnectionID {
+		c.AbortWithStatusJSON(BadRequest("wrong_data"))
+		return
+	}
+
 	conn := getConnectionById(b.ConnectionID)
 	if conn.MGURL == "" || conn.MGToken == "" {
 		c.AbortWithStatusJSON(BadRequest("not_found_account"))
 		return
 	}
 
-	var client = v1.New(conn.MGURL, conn.MGToken)
+	var client = v1.New(conn.MGURL, string(conn.MGToken))
 	client.Debug = config.Debug
 
 	data, status, err := client.DeactivateTransportChannel(getBotChannelByToken(b.Token))
@@ -126,6 +152,8 @@ func deleteBotHandler(c *gin.Context) {
 		return
 	}
 
+	invalidateBot(cl.ID, cl.ConnectionID)
+
 	c.JSON(http.StatusOK, gin.H{})
 }
 
@@ -138,20 +166,41 @@ func settingsHandler(c *gin.Context) {
 		return
 	}
 
+	// session is started by the signed link from retailCRM, the signature is removed from the address then
+	if isAccountSignatureValid(p.ClientID, c.Query(accountSignParam)) {
+		startSession(c, p.ClientID)
+		c.Redirect(http.StatusFound, "/settings/"+p.ClientID)
+		return
+	}
+
+	session, ok := getSession(c, p.ClientID)
+	if !ok {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
 	bots := p.getBotsByClientID()
 
 	res := struct {
-		Conn     *Connection
-		Bots     Bots
-		Locale   map[string]interface{}
-		Year     int
-		LangCode []string
+		Conn              *Connection
+		Bots              Bots
+		Locale            map[string]interface{}
+		Year              int
+		LangCode          []string
+		GroupModes        []groupModeOption
+		UpdateModes       []updateModeOption
+		DefaultUpdateMode string
+		CSRFToken         string
 	}{
 		p,
 		bots,
 		getLocale(),
 		time.Now().Year(),
 		[]string{"en", "ru", "es"},
+		getGroupModeOptions(),
+		getUpdateModeOptions(),
+		(&Bot{}).getUpdateMode(),
+		getCSRFToken(session),
 	}
 
 	c.HTML(http.StatusOK, "form", &res)
@@ -159,7 +208,7 @@ func settingsHandler(c *gin.Context) {
 
 func saveHandler(c *gin.Context) {
 	conn := c.MustGet("connection").(Connection)
-	_, err, code := getAPIClient(conn.APIURL, conn.APIKEY)
+	_, err, code := getAPIClient(conn.APIURL, string(conn.APIKEY))
 	if err != nil {
 		if code == http.StatusInternalServerError {
 			c.Error(err)
@@ -187,7 +236,7 @@ func createHandler(c *gin.Context) {
 		return
 	}
 
-	client, err, code := getAPIClient(conn.APIURL, conn.APIKEY)
+	client, err, code := getAPIClient(conn.APIURL, string(conn.APIKEY))
 	if err != nil {
 		if code == http.StatusInternalServerError {
 			c.Error(err)
@@ -217,7 +266,8 @@ func createHandler(c *gin.Context) {
 	}
 
 	conn.MGURL = data.Info.MgTransportInfo.EndpointUrl
-	conn.MGToken = data.Info.MgTransportInfo.Token
+	conn.MGToken = EncryptedString(data.Info.MgTransportInfo.Token)
+	conn.ModuleHash = getIntegrationModuleHash(conn.ClientID)
 	conn.Active = true
 
 	err = conn.createConnection()
@@ -229,7 +279,7 @@ func createHandler(c *gin.Context) {
 	c.JSON(
 		http.StatusCreated,
 		gin.H{
-			"url":     "/settings/" + conn.ClientID,
+			"url":     getAccountPath(conn.ClientID),
 			"message": getLocalizedMessage("successful"),
 		},
 	)
@@ -270,18 +320,23 @@ func activityHandler(c *gin.Context) {
 		conn.APIURL = systemUrl
 	}
 
-	hashSettings, err := getChannelSettingsHash()
-	if err != nil {
-		logger.Errorf("activityHandler hashSettings apiURl: %s, err: %s", conn.APIURL, err.Error())
-	} else {
-		updateBots(conn, hashSettings)
-	}
-
 	if err := conn.saveConnection(); err != nil {
 		c.Error(err)
 		return
 	}
 
+	// channels of reactivated connection are reconciled at once, it is skipped when inactive
+	go func(id int) {
+		hashSettings, err := getChannelSettingsHash()
+		if err == nil {
+			_, err = reconcileConnection(id, hashSettings, reconcileOptions{Force: true})
+		}
+
+		if err != nil {
+			logger.Errorf("activityHandler reconcile connection %d: %s", id, err.Error())
+		}
+	}(conn.ID)
+
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
@@ -293,6 +348,11 @@ func setLangBotHandler(c *gin.Context) {
 		return
 	}
 
+	if cl.ID == 0 || cl.ConnectionID != b.ConnectionID {
+		c.AbortWithStatusJSON(BadRequest("wrong_data"))
+		return
+	}
+
 	cl.Lang = b.Lang
 
 	err = cl.save()
@@ -304,6 +364,85 @@ func setLangBotHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{})
 }
 
+func setGroupModeBotHandler(c *gin.Context) {
+	b := c.MustGet("bot").(Bot)
+	if !isValidGroupMode(b.GroupMode) {
+		c.AbortWithStatusJSON(BadRequest("wrong_data"))
+		return
+	}
+
+	cl, err := getBotByToken(b.Token)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if cl.ID == 0 || cl.ConnectionID != b.ConnectionID {
+		c.AbortWithStatusJSON(BadRequest("wrong_data"))
+		return
+	}
+
+	cl.GroupMode = b.GroupMode
+
+	err = cl.save()
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+func setUpdateModeBotHandler(c *gin.Context) {
+	b := c.MustGet("bot").(Bot)
+	if b.UpdateMode == "" || !isValidUpdateMode(b.UpdateMode) {
+		c.AbortWithStatusJSON(BadRequest("wrong_data"))
+		return
+	}
+
+	cl, err := getBotByToken(b.Token)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if cl.ID == 0 || cl.ConnectionID != b.ConnectionID {
+		c.AbortWithStatusJSON(BadRequest("wrong_data"))
+		return
+	}
+
+	bot, err := getBotAPI(cl)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	// polling loop deletes webhook itself, it is deleted here to stop webhook deliveries at once
+	var wr tgbotapi.APIResponse
+	if b.UpdateMode == UpdateModePolling {
+		wr, err = bot.RemoveWebhook()
+	} else {
+		wr, err = setWebhook(bot, cl)
+	}
+
+	if err != nil || !wr.Ok {
+		c.AbortWithStatusJSON(BadRequest("error_creating_webhook"))
+		logger.Error(cl.ID, err, wr)
+		return
+	}
+
+	cl.UpdateMode = b.UpdateMode
+	cl.WebhookMigrated = true
+
+	err = cl.save()
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{})
+}
+
 func getIntegrationModule(clientId string) v5.IntegrationModule {
 	return v5.IntegrationModule{
 		Code:            config.TransportInfo.Code,
@@ -321,9 +460,9 @@ func getIntegrationModule(clientId string) v5.IntegrationModule {
 			config.HTTPServer.Host,
 		),
 		AccountURL: fmt.Sprintf(
-			"https://%s/settings/%s",
+			"https://%s%s",
 			config.HTTPServer.Host,
-			clientId,
+			getAccountPath(clientId),
 		),
 		Actions: map[string]string{"activity": "/actions/activity"},
 		Integrations: &v5.Integrations{
@@ -337,311 +476,223 @@ func getIntegrationModule(clientId string) v5.IntegrationModule {
 	}
 }
 
-func getChannelSettings(cid ...uint64) v1.Channel {
+func getChannelSettings(cid ...uint64) Channel {
 	var channelID uint64
 
 	if len(cid) > 0 {
 		channelID = cid[0]
 	}
 
-	return v1.Channel{
-		ID:   channelID,
-		Type: Type,
-		Settings: v1.ChannelSettings{
-			SpamAllowed: false,
-			Status: v1.Status{
-				Delivered: v1.ChannelFeatureSend,
-				Read:      v1.ChannelFeatureNone,
-			},
-			Text: v1.ChannelSettingsText{
-				Creating:      v1.ChannelFeatureBoth,
-				Editing:       v1.ChannelFeatureBoth,
-				Quoting:       v1.ChannelFeatureBoth,
-				Deleting:      v1.ChannelFeatureReceive,
-				MaxCharsCount: MaxCharsCount,
-			},
-			Product: v1.Product{
-				Creating: v1.ChannelFeatureReceive,
-				Editing:  v1.ChannelFeatureReceive,
-			},
-			Order: v1.Order{
-				Creating: v1.ChannelFeatureReceive,
-				Editing:  v1.ChannelFeatureReceive,
+	return Channel{
+		Channel: v1.Channel{
+			ID:   channelID,
+			Type: Type,
+		},
+		Settings: ChannelSettings{
+			ChannelSettings: v1.ChannelSettings{
+				SpamAllowed: false,
+				Status: v1.Status{
+					Delivered: v1.ChannelFeatureSend,
+					Read:      v1.ChannelFeatureSend,
+				},
+				Text: v1.ChannelSettingsText{
+					Creating:      v1.ChannelFeatureBoth,
+					Editing:       v1.ChannelFeatureBoth,
+					Quoting:       v1.ChannelFeatureBoth,
+					Deleting:      v1.ChannelFeatureReceive,
+					MaxCharsCount: MaxCharsCount,
+				},
+				Product: v1.Product{
+					Creating: v1.ChannelFeatureReceive,
+					Editing:  v1.ChannelFeatureReceive,
+				},
+				Order: v1.Order{
+					Creating: v1.ChannelFeatureReceive,
+					Editing:  v1.ChannelFeatureReceive,
+				},
+				File: v1.ChannelSettingsFilesBase{
+					Creating: v1.ChannelFeatureBoth,
+					Editing:  v1.ChannelFeatureBoth,
+					Quoting:  v1.ChannelFeatureBoth,
+					Deleting: v1.ChannelFeatureReceive,
+					Max:      1,
+				},
+				Image: v1.ChannelSettingsFilesBase{
+					Creating: v1.ChannelFeatureBoth,
+					Editing:  v1.ChannelFeatureBoth,
+					Quoting:  v1.ChannelFeatureBoth,
+					Deleting: v1.ChannelFeatureReceive,
+					Max:      10,
+				},
 			},
-			File: v1.ChannelSettingsFilesBase{
+			Audio: ChannelSettingsAudio{
 				Creating: v1.ChannelFeatureBoth,
-				Editing:  v1.ChannelFeatureBoth,
 				Quoting:  v1.ChannelFeatureBoth,
 				Deleting: v1.ChannelFeatureReceive,
 				Max:      1,
 			},
-			Image: v1.ChannelSettingsFilesBase{
-				Creating: v1.ChannelFeatureBoth,
-				Editing:  v1.ChannelFeatureBoth,
-				Quoting:  v1.ChannelFeatureBoth,
-				Deleting: v1.ChannelFeatureReceive,
-				Max:      10,
+			Suggestions: ChannelSettingsSuggestions{
+				Text:  v1.ChannelFeatureSend,
+				Phone: v1.ChannelFeatureSend,
+				Email: v1.ChannelFeatureSend,
+				URL:   v1.ChannelFeatureSend,
 			},
 		},
 	}
 }
 
-func updateChannelsSettings() {
-	hashSettings, err := getChannelSettingsHash()
-	if err != nil {
-		logger.Error(err.Error())
-		return
-	}
-
-	connections := getConnections()
-	if len(connections) > 0 {
-		for _, conn := range connections {
-			if !conn.Active {
-				logger.Infof(
-					"updateChannelsSettings connection %s deactivated",
-					conn.APIURL,
-				)
-				continue
-			}
-			updateBots(conn, hashSettings)
-		}
-	}
-
-	return
-}
-
-func updateBots(conn *Connection, hashSettings string) {
-	var channelIDs []uint64
-	bots := conn.getBotsByClientID()
-
-	if len(bots) > 0 {
-		client := v1.New(conn.MGURL, conn.MGToken)
-		client.Debug = config.Debug
-		for _, bot := range bots {
-			channelIDs = append(channelIDs, bot.Channel)
-			if bot.ChannelSettingsHash == hashSettings {
-				continue
-			}
-
-			channelSettings := getChannelSettings(bot.Channel)
-			if bot.Name != "" {
-				channelSettings.Name = "@" + bot.Name
-			}
-
-			data, status, err := client.UpdateTransportChannel(channelSettings)
-			if config.Debug {
-				logger.Infof(
-					"updateChannelsSettings apiURL: %s, ChannelID: %d, Data: %v, Status: %d, err: %v",
-					conn.APIURL, bot.Channel, data, status, err,
-				)
-			}
-
-			if err == nil {
-				bot.ChannelSettingsHash = hashSettings
-				err = bot.save()
-				if err != nil {
-					logger.Error(
-						"updateChannelsSettings bot.save apiURL: %s, bot.Channel: %d , err: %v",
-						conn.APIURL, bot.Channel, err,
-					)
-				}
-			}
-		}
+func telegramWebhookHandler(c *gin.Context) {
+	b := c.MustGet("bot").(Bot)
 
-		deactivateChannels(client, channelIDs)
+	conn := getCachedConnectionByID(b.ConnectionID)
+	if !conn.Active || b.getUpdateMode() != UpdateModeWebhook {
+		c.AbortWithStatus(http.StatusOK)
+		return
 	}
 
-	return
-}
-
-func deactivateChannels(client *v1.MgClient, channelIDs []uint64) {
-	channelListItems, status, err := client.TransportChannels(v1.Channels{Active: true})
-	if config.Debug {
-		logger.Debugf(
-			"TransportChannels ChannelListItems: %+v, Status: %d, err: %v",
-			channelListItems, status, err,
-		)
+	payload, err := c.GetRawData()
+	if err != nil {
+		c.Error(err)
+		return
 	}
 
-	if len(channelListItems) > 0 {
-		for _, channel := range channelIDs {
-			for key, ch := range channelListItems {
-				if channel == ch.ID {
-					if len(channelListItems) == 1 {
-						channelListItems = channelListItems[:0]
-						break
-					}
-
-					channelListItems = append(channelListItems[:key], channelListItems[key+1:]...)
-				}
-			}
-		}
+	if err := enqueueUpdate(b, payload); err != nil {
+		c.Error(err)
+		return
 	}
 
-	if len(channelListItems) > 0 {
-		for _, ch := range channelListItems {
-			channelListItems, status, err := client.DeactivateTransportChannel(ch.ID)
-			if config.Debug {
-				logger.Debugf(
-					"DeactivateTransportChannel  ChannelListItems: %+v, Status: %d, err: %v",
-					channelListItems, status, err,
-				)
-			}
-		}
-	}
+	c.JSON(http.StatusOK, gin.H{})
 }
 
-func telegramWebhookHandler(c *gin.Context) {
-	b := c.MustGet("bot").(Bot)
-
-	conn := getConnectionById(b.ConnectionID)
+// processUpdate sends Telegram update to MG, returned error means the update should be retried
+func processUpdate(b Bot, update Update) error {
+	conn := getCachedConnectionByID(b.ConnectionID)
 	if !conn.Active {
-		c.AbortWithStatus(http.StatusOK)
-		return
-	}
-
-	var update tgbotapi.Update
-	if err := c.ShouldBindJSON(&update); err != nil {
-		c.Error(err)
-		return
+		return nil
 	}
 
 	if config.Debug {
 		logger.Debugf(
-			"mgWebhookHandler request:\nUpdateID: %v,\nMessage: %+v,\nEditedMessage: %+v",
+			"processUpdate:\nUpdateID: %v,\nMessage: %+v,\nEditedMessage: %+v",
 			update.UpdateID, update.Message, update.EditedMessage,
 		)
 	}
 
 	if update.Message != nil && shouldMessageBeIgnored(update.Message) {
-		logger.Infof("telegramWebhookHandler ignoring unprocessable message %+v", update.Message)
-		return
+		logger.Infof("processUpdate ignoring unprocessable message %+v", update.Message)
+		return nil
 	}
 
-	var client = v1.New(conn.MGURL, conn.MGToken)
-	client.Debug = config.Debug
-
-	if update.Message != nil {
-		nickname := update.Message.From.UserName
-		user := getUserByExternalID(update.Message.From.ID)
-
-		if update.Message.From.UserName == "" {
-			nickname = update.Message.From.FirstName
-		}
-
-		if user.Expired(config.UpdateInterval) || user.ID == 0 {
-			fileID, fileURL, err := GetFileIDAndURL(b.Token, update.Message.From.ID)
-			if err != nil {
-				c.Error(err)
-				return
-			}
-
-			if fileID != user.UserPhotoID && fileURL != "" {
-				picURL, err := UploadUserAvatar(fileURL)
-				if err != nil {
-					c.Error(err)
-					return
-				}
+	if update.Message != nil && !b.acceptsMessage(update.Message) ||
+		update.EditedMessage != nil && !b.acceptsMessage(update.EditedMessage) {
+		return nil
+	}
 
-				user.UserPhotoID = fileID
-				user.UserPhotoURL = picURL
-			}
+	client := getMGClient(conn)
 
-			if user.ExternalID == 0 {
-				user.ExternalID = update.Message.From.ID
-			}
+	if update.Message != nil {
+		var customer v1.Customer
 
-			err = user.save()
+		if update.Message.SenderChat != nil {
+			customer = getSenderChatCustomer(update.Message.SenderChat)
+		} else {
+			c, err := getCustomer(b, update.Message.From)
 			if err != nil {
-				c.Error(err)
-				return
+				return err
 			}
-		}
-
-		lang := update.Message.From.LanguageCode
 
-		if len(update.Message.From.LanguageCode) > 2 {
-			lang = update.Message.From.LanguageCode[:2]
-		}
-
-		if config.Debug {
-			logger.Debugf("telegramWebhookHandler user %+v", user)
+			customer = c
+			linkCRMCustomerAsync(conn, update.Message.From, getSharedPhone(update.Message))
 		}
 
 		snd := v1.SendData{
 			Message: v1.Message{
 				ExternalID: strconv.Itoa(update.Message.MessageID),
 				Type:       "text",
-				Text:       update.Message.Text,
-			},
-			Originator: v1.OriginatorCustomer,
-			Customer: v1.Customer{
-				ExternalID: strconv.Itoa(update.Message.From.ID),
-				Nickname:   nickname,
-				Firstname:  update.Message.From.FirstName,
-				Avatar:     user.UserPhotoURL,
-				Lastname:   update.Message.From.LastName,
-				Language:   lang,
+				Text:       getMessageText(update.Message),
 			},
+			Originator:     v1.OriginatorCustomer,
+			Customer:       customer,
 			Channel:        b.Channel,
-			ExternalChatID: strconv.FormatInt(update.Message.Chat.ID, 10),
+			ExternalChatID: getExternalChatID(update.Message),
 		}
 
-		if update.Message.ReplyToMessage != nil {
-			snd.Quote = &v1.SendMessageRequestQuote{ExternalID: strconv.Itoa(update.Message.ReplyToMessage.MessageID)}
+		if update.Message.ReplyToMessage != nil && !update.Message.isReplyToTopic() {
+			snd.Quote = &v1.SendMessageRequestQuote{
+				ExternalID: getQuoteExternalID(&b, update.Message.Chat.ID, update.Message.ReplyToMessage.MessageID),
+			}
 		}
 
 		if snd.Message.Text == "" {
 			setLocale(update.Message.From.LanguageCode)
 
-			err := setAttachment(update.Message, client, &snd, b.Token)
+			err := setAttachment(update.Message, client, &snd, &b)
 			if err != nil {
 				logger.Error(client.Token, err.Error())
-				c.AbortWithStatus(http.StatusBadRequest)
-				return
+				return err
 			}
 		}
 
+		markOperatorMessagesRead(client, &b, update.Message.Chat.ID)
+
 		data, st, err := client.Messages(snd)
 		if err != nil {
 			logger.Error(b.Token, err.Error(), st, data)
 
 			if update.Message.ReplyToMessage != nil {
-				c.AbortWithStatus(http.StatusOK)
-			} else if st == http.StatusBadRequest && err.Error() == "Message with passed external_id already exists" {
+				return nil
+			}
+
+			if st == http.StatusBadRequest && err.Error() == "Message with passed external_id already exists" {
 				logger.Errorf("Message with externalId '%s' is already exists - ignoring it", snd.Message.ExternalID)
-				c.JSON(http.StatusOK, gin.H{})
-			} else {
-				c.Error(err)
+				return nil
 			}
 
-			return
+			return err
+		}
+
+		mm := MessageMap{
+			BotID:       b.ID,
+			ChatID:      update.Message.Chat.ID,
+			MessageID:   update.Message.MessageID,
+			ExternalID:  snd.Message.ExternalID,
+			MGMessageID: int64(data.MessageID),
+			Direction:   MessageDirectionIn,
+		}
+
+		if err := mm.save(); err != nil {
+			logger.Error(b.ID, err.Error())
 		}
 
 		if config.Debug {
-			logger.Debugf("telegramWebhookHandler Type: SendMessage, Bot: %v, Message: %+v, Response: %+v", b.ID, snd, data)
+			logger.Debugf("processUpdate Type: SendMessage, Bot: %v, Message: %+v, Response: %+v", b.ID, snd, data)
 		}
 	}
 
 	if update.EditedMessage != nil {
+		text := getMessageText(update.EditedMessage)
 		if update.EditedMessage.Text == "" {
 			if getMessageID(update.EditedMessage) != "undefined" {
-				if config.Debug {
-					logger.Debug(b.Token, update.EditedMessage, "Only text messages can be updated")
+				// media message is updated with its caption
+				if update.EditedMessage.Caption == "" {
+					if config.Debug {
+						logger.Debug(b.Token, update.EditedMessage, "Media without caption can not be updated")
+					}
+
+					return nil
 				}
-				c.JSON(http.StatusOK, gin.H{})
 
-				return
+				text = getCaptionText(update.EditedMessage)
+			} else {
+				setLocale(update.EditedMessage.From.LanguageCode)
+				text = getLocalizedMessage(getMessageID(update.EditedMessage))
 			}
-
-			setLocale(update.EditedMessage.From.LanguageCode)
-			update.EditedMessage.Text = getLocalizedMessage(getMessageID(update.Message))
 		}
 
 		snd := v1.EditMessageRequest{
 			Message: v1.EditMessageRequestMessage{
 				ExternalID: strconv.Itoa(update.EditedMessage.MessageID),
-				Text:       update.EditedMessage.Text,
+				Text:       text,
 			},
 			Channel: b.Channel,
 		}
@@ -649,22 +700,187 @@ func telegramWebhookHandler(c *gin.Context) {
 		data, st, err := client.UpdateMessages(snd)
 		if err != nil {
 			logger.Error(b.Token, err.Error(), st, data)
-			c.Error(err)
-			return
+			return err
 		}
 
 		if config.Debug {
-			logger.Debugf("telegramWebhookHandler Type: UpdateMessage, Bot: %v, Message: %v, Response: %v", b.ID, snd, data)
+			logger.Debugf("processUpdate Type: UpdateMessage, Bot: %v, Message: %v, Response: %v", b.ID, snd, data)
 		}
 	}
 
-	c.JSON(http.StatusOK, gin.H{})
+	if update.CallbackQuery != nil && update.CallbackQuery.Message != nil {
+		return processCallbackQuery(b, client, update.CallbackQuery)
+	}
+
+	if update.MyChatMember != nil {
+		return processMyChatMember(b, client, update.UpdateID, update.MyChatMember)
+	}
+
+	return nil
+}
+
+// processMyChatMember records whether the bot can write to the chat,
+// MG is told when customer blocks or restarts the bot in a private chat
+func processMyChatMember(b Bot, client *v1.MgClient, updateID int, u *ChatMemberUpdated) error {
+	blocked := u.isBlocked()
+	if blocked == isChatBlocked(b.ID, u.Chat.ID) {
+		return nil
+	}
+
+	if err := setChatBlocked(b.ID, u.Chat.ID, blocked); err != nil {
+		return err
+	}
+
+	if !u.Chat.IsPrivate() {
+		return nil
+	}
+
+	customer, err := getCustomer(b, &u.From)
+	if err != nil {
+		return err
+	}
+
+	setLocale(u.From.LanguageCode)
+	text := getLocalizedMessage("customer_restarted_bot")
+	if blocked {
+		text = getLocalizedMessage("customer_blocked_bot")
+	}
+
+	// transport API accepts only customer and channel originators and no system messages,
+	// the notice is added on behalf of the channel so that it is not shown as written by customer
+	snd := v1.SendData{
+		Message: v1.Message{
+			ExternalID: memberMessagePrefix + strconv.Itoa(updateID),
+			Type:       v1.MsgTypeText,
+			Text:       text,
+		},
+		Originator:     v1.OriginatorChannel,
+		Customer:       customer,
+		Channel:        b.Channel,
+		ExternalChatID: strconv.FormatInt(u.Chat.ID, 10),
+	}
+
+	data, st, err := client.Messages(snd)
+	if err != nil {
+		logger.Error(b.Token, err.Error(), st, data)
+		return err
+	}
+
+	if config.Debug {
+		logger.Debugf("processMyChatMember Bot: %v, Message: %+v, Response: %+v", b.ID, snd, data)
+	}
+
+	return nil
+}
+
+// getCustomer returns MG customer for Telegram user refreshing the avatar when it is expired
+func getCustomer(b Bot, from *tgbotapi.User) (v1.Customer, error) {
+	nickname := from.UserName
+	user := getUserByExternalID(from.ID)
+
+	if from.UserName == "" {
+		nickname = from.FirstName
+	}
+
+	if config.AvatarProxy.Enabled {
+		// avatar is fetched from Telegram when MG requests it
+		user.UserPhotoURL = getAvatarProxyURL(&b, from.ID)
+	} else if user.Expired(config.UpdateInterval) || user.ID == 0 {
+		fileID, fileURL, err := GetFileIDAndURL(&b, from.ID)
+		if err != nil {
+			return v1.Customer{}, err
+		}
+
+		if fileID != user.UserPhotoID && fileURL != "" {
+			picURL, err := UploadUserAvatar(fileURL)
+			if err != nil {
+				return v1.Customer{}, err
+			}
+
+			user.UserPhotoID = fileID
+			user.UserPhotoURL = picURL
+		}
+
+		if user.ExternalID == 0 {
+			user.ExternalID = from.ID
+		}
+
+		err = user.save()
+		if err != nil {
+			return v1.Customer{}, err
+		}
+	}
+
+	lang := from.LanguageCode
+
+	if len(from.LanguageCode) > 2 {
+		lang = from.LanguageCode[:2]
+	}
+
+	if config.Debug {
+		logger.Debugf("getCustomer user %+v", user)
+	}
+
+	return v1.Customer{
+		ExternalID: strconv.Itoa(from.ID),
+		Nickname:   nickname,
+		Firstname:  from.FirstName,
+		Avatar:     user.UserPhotoURL,
+		Lastname:   from.LastName,
+		Language:   lang,
+	}, nil
+}
+
+// processCallbackQuery sends title of the inline button customer tapped to MG as customer message
+func processCallbackQuery(b Bot, client *v1.MgClient, q *CallbackQuery) error {
+	customer, err := getCustomer(b, q.From)
+	if err != nil {
+		return err
+	}
+
+	snd := v1.SendData{
+		Message: v1.Message{
+			ExternalID: callbackMessagePrefix + q.ID,
+			Type:       v1.MsgTypeText,
+			Text:       getCallbackButtonText(q),
+		},
+		Originator:     v1.OriginatorCustomer,
+		Customer:       customer,
+		Channel:        b.Channel,
+		ExternalChatID: getExternalChatID(q.Message),
+	}
+
+	data, st, err := client.Messages(snd)
+	if err != nil {
+		logger.Error(b.ID, err.Error(), st, data)
+
+		if st != http.StatusBadRequest || err.Error() != "Message with passed external_id already exists" {
+			return err
+		}
+	}
+
+	if config.Debug {
+		logger.Debugf("processCallbackQuery Bot: %v, Message: %+v, Response: %+v", b.ID, snd, data)
+	}
+
+	// stop the progress indicator on the button
+	bot, err := getBotAPI(&b)
+	if err != nil {
+		logger.Error(b.ID, err.Error())
+		return nil
+	}
+
+	if _, err := bot.AnswerCallbackQuery(tgbotapi.NewCallback(q.ID, "")); err != nil {
+		logger.Error(b.ID, err.Error())
+	}
+
+	return nil
 }
 
 func mgWebhookHandler(c *gin.Context) {
 	conn := c.MustGet("connection").(Connection)
 
-	var msg v1.WebhookRequest
+	var msg WebhookRequest
 	if err := c.ShouldBindJSON(&msg); err != nil {
 		c.Error(err)
 		return
@@ -674,8 +890,7 @@ func mgWebhookHandler(c *gin.Context) {
 		logger.Debugf("mgWebhookHandler request: %+v", msg)
 	}
 
-	uid, _ := strconv.Atoi(msg.Data.ExternalMessageID)
-	cid, _ := strconv.ParseInt(msg.Data.ExternalChatID, 10, 64)
+	cid, _ := parseExternalChatID(msg.Data.ExternalChatID)
 
 	b := getBot(conn.ID, msg.Data.ChannelID)
 	if b.ID == 0 {
@@ -683,95 +898,72 @@ func mgWebhookHandler(c *gin.Context) {
 		return
 	}
 
-	bot, err := tgbotapi.NewBotAPI(b.Token)
+	bot, err := getBotAPI(b)
 	if err != nil {
-		logger.Error(b, err)
+		logger.Error(b.ID, err)
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
 
-	bot.Debug = config.Debug
 	setLocale(b.Lang)
-	mgClient := v1.New(conn.MGURL, conn.MGToken)
+	mgClient := getMGClient(&conn)
 
 	switch msg.Type {
 	case "message_sent":
-		var mb string
-		var m tgbotapi.Chattable
+		if isChatBlocked(b.ID, cid) {
+			c.JSON(http.StatusOK, MessageSentResponse{Error: blockedChatError()})
+			return
+		}
 
-		switch msg.Data.Type {
-		case v1.MsgTypeProduct:
-			mb = fmt.Sprintf("*%s*\n", replaceMarkdownSymbols(msg.Data.Product.Name))
+		if hasQueuedOutboundMessages(b.ID, cid) {
+			enqueueWebhookMessage(c, b, cid, msg, "")
+			return
+		}
 
-			if msg.Data.Product.Cost != nil && msg.Data.Product.Cost.Value != 0 {
-				mb += fmt.Sprintf(
-					"\n%s: %s\n",
-					getLocalizedMessage("item_cost"),
-					getLocalizedTemplateMessage(
-						"cost_currency",
-						map[string]interface{}{
-							"Amount":   msg.Data.Product.Cost.Value,
-							"Currency": currency[strings.ToLower(msg.Data.Product.Cost.Currency)],
-						},
-					),
-				)
+		messages, err := getWebhookMessage(&conn, b, msg.Data, mgClient, cid, getFormatter())
+		if err != nil {
+			if err == errEmptyMessage {
+				return
 			}
 
-			if msg.Data.Product.Url != "" {
-				mb += replaceMarkdownSymbols(msg.Data.Product.Url)
-			} else {
-				mb += replaceMarkdownSymbols(msg.Data.Product.Img)
-			}
-		case v1.MsgTypeOrder:
-			mb = getOrderMessage(msg.Data.Order)
-		case v1.MsgTypeText:
-			mb = replaceMarkdownSymbols(msg.Data.Content)
-		case v1.MsgTypeImage:
-			m, err = photoMessage(msg.Data, mgClient, cid)
-			if err != nil {
-				logger.Errorf(
-					"GetFile request apiURL: %s, clientID: %s, err: %s",
-					conn.APIURL, conn.ClientID, err.Error(),
-				)
+			if _, ok := isFileTooLarge(err); ok {
+				c.JSON(http.StatusOK, MessageSentResponse{Error: getMessageSentError(err)})
 				return
 			}
-		case v1.MsgTypeFile:
-			items := *msg.Data.Items
-			if len(items) > 0 {
-				m, err = documentMessage(items[0], mgClient, cid)
-				if err != nil {
-					logger.Errorf(
-						"GetFile request apiURL: %s, clientID: %s, err: %s",
-						conn.APIURL, conn.ClientID, err.Error(),
-					)
-					return
-				}
-			}
+
+			c.Error(err)
+			return
 		}
 
-		if mb != "" {
-			m, err = textMessage(cid, mb, msg.Data.QuoteExternalID)
-			if err != nil {
-				c.Error(err)
+		// message is sent while MG waits so that delivery error reaches operator,
+		// parts of long message wait for the rate limit slot the queue would wait for as well
+		_, externalID, err := sendWebhookParts(&conn, b, bot, msg.Data, mgClient, cid, messages, "")
+		if err != nil {
+			if retry, after := retryableSendError(err); retry {
+				logger.Warningf("mgWebhookHandler bot %d chat %d: %s, queueing message", b.ID, cid, err.Error())
+				postponeSend(b, cid, after)
+				enqueueWebhookMessage(c, b, cid, msg, externalID)
 				return
 			}
-		}
 
-		msgSend, err := bot.Send(m)
-		if err != nil {
 			logger.Error(err)
-			c.AbortWithStatus(http.StatusBadRequest)
-			return
+			flagBlockedChat(b, cid, err)
+
+			// first parts are delivered already, MG gets their ID so that they can be edited and quoted
+			if externalID == "" {
+				c.JSON(http.StatusOK, MessageSentResponse{Error: getMessageSentError(err)})
+				return
+			}
 		}
 
 		if config.Debug {
-			logger.Debugf("mgWebhookHandler sent %+v", msgSend)
+			logger.Debugf("mgWebhookHandler sent %s", externalID)
 		}
 
-		c.JSON(http.StatusOK, gin.H{"external_message_id": strconv.Itoa(msgSend.MessageID)})
+		c.JSON(http.StatusOK, MessageSentResponse{ExternalMessageID: externalID})
 
 	case "message_updated":
-		msgSend, err := bot.Send(tgbotapi.NewEditMessageText(cid, uid, replaceMarkdownSymbols(msg.Data.Content)))
+		err := editSentMessages(bot, b, mgClient, msg.Data)
 		if err != nil {
 			logger.Error(err)
 			c.AbortWithStatus(http.StatusBadRequest)
@@ -779,13 +971,13 @@ func mgWebhookHandler(c *gin.Context) {
 		}
 
 		if config.Debug {
-			logger.Debugf("mgWebhookHandler update %+v", msgSend)
+			logger.Debugf("mgWebhookHandler update %s", msg.Data.ExternalMessageID)
 		}
 
 		c.AbortWithStatus(http.StatusOK)
 
 	case "message_deleted":
-		msgSend, err := bot.Send(tgbotapi.NewDeleteMessage(cid, uid))
+		err := deleteSentMessages(bot, b, cid, msg.Data.ExternalMessageID)
 		if err != nil {
 			logger.Error(err)
 			c.AbortWithStatus(http.StatusBadRequest)
@@ -793,73 +985,178 @@ func mgWebhookHandler(c *gin.Context) {
 		}
 
 		if config.Debug {
-			logger.Debugf("mgWebhookHandler delete %+v", msgSend)
+			logger.Debugf("mgWebhookHandler delete %s", msg.Data.ExternalMessageID)
 		}
 
 		c.JSON(http.StatusOK, gin.H{})
 	}
 }
 
-func getOrderMessage(dataOrder *v1.MessageDataOrder) string {
-	mb := "*" + getLocalizedMessage("order")
+// getWebhookMessage builds Telegram messages from MG webhook data, long text is split into several messages
+func getWebhookMessage(conn *Connection, b *Bot, data WebhookData, mgClient *v1.MgClient, cid int64, f Formatter) (messages []tgbotapi.Chattable, err error) {
+	var (
+		m         tgbotapi.Chattable
+		texts     []string
+		parseMode = f.ParseMode()
+	)
+
+	switch data.Type {
+	case v1.MsgTypeProduct:
+		texts = getProductMessage(f, data.Product).Split(int(MaxCharsCount), int(MaxCharsCount))
+	case v1.MsgTypeOrder:
+		texts = getOrderMessage(f, data.Order).Split(int(MaxCharsCount), int(MaxCharsCount))
+	case v1.MsgTypeText:
+		texts = newFormattedText(f).Text(data.Content).Split(int(MaxCharsCount), int(MaxCharsCount))
+	case v1.MsgTypeImage:
+		// caption exceeding Telegram limit is continued in text messages
+		captions := newFormattedText(plainFormatter{}).Text(data.Content).Split(maxCaptionLength, int(MaxCharsCount))
+		texts, parseMode = captions[1:], ""
+
+		m, err = photoMessage(data.WebhookData, captions[0], mgClient, cid)
+		if err != nil {
+			if _, ok := isFileTooLarge(err); ok {
+				return nil, err
+			}
+
+			logger.Errorf(
+				"GetFile request apiURL: %s, clientID: %s, err: %s",
+				conn.APIURL, conn.ClientID, err.Error(),
+			)
+			return nil, errEmptyMessage
+		}
+	case v1.MsgTypeFile, v1.MsgTypeAudio:
+		var items []v1.FileItem
+		if data.Items != nil {
+			items = *data.Items
+		}
+
+		if len(items) > 0 {
+			m, err = documentMessage(items[0], data.Type, mgClient, cid)
+			if err != nil {
+				if _, ok := isFileTooLarge(err); ok {
+					return nil, err
+				}
+
+				logger.Errorf(
+					"GetFile request apiURL: %s, clientID: %s, err: %s",
+					conn.APIURL, conn.ClientID, err.Error(),
+				)
+				return nil, errEmptyMessage
+			}
+		}
+	}
+
+	if m != nil {
+		messages = append(messages, m)
+	}
+
+	for _, text := range texts {
+		if text == "" {
+			continue
+		}
+
+		var quoteID int
+		if len(messages) == 0 {
+			quoteID = getQuotedMessageID(b, cid, data.QuoteExternalID)
+		}
+
+		messages = append(messages, textMessage(cid, text, quoteID, parseMode))
+	}
+
+	if len(messages) == 0 {
+		return nil, errEmptyMessage
+	}
+
+	if data.TransportAttachments != nil {
+		last := len(messages) - 1
+		messages[last] = setReplyMarkup(messages[last], getReplyMarkup(data.TransportAttachments.Suggestions))
+	}
+
+	_, threadID := parseExternalChatID(data.ExternalChatID)
+	for i := range messages {
+		messages[i] = setMessageThread(messages[i], threadID)
+	}
+
+	return messages, nil
+}
+
+func getProductMessage(f Formatter, product *v1.MessageDataProduct) *formattedText {
+	mb := newFormattedText(f).Bold(product.Name).Text("\n")
+
+	if product.Cost != nil && product.Cost.Value != 0 {
+		mb.Text(fmt.Sprintf(
+			"\n%s: %s\n",
+			getLocalizedMessage("item_cost"),
+			getLocalizedTemplateMessage(
+				"cost_currency",
+				map[string]interface{}{
+					"Amount":   product.Cost.Value,
+					"Currency": currency[strings.ToLower(product.Cost.Currency)],
+				},
+			),
+		))
+	}
+
+	if product.Url != "" {
+		mb.Text(product.Url)
+	} else {
+		mb.Text(product.Img)
+	}
+
+	return mb
+}
+
+func getOrderMessage(f Formatter, dataOrder *v1.MessageDataOrder) *formattedText {
+	title := getLocalizedMessage("order")
 
 	if dataOrder.Number != "" {
-		mb += " " + replaceMarkdownSymbols(dataOrder.Number)
+		title += " " + dataOrder.Number
 	}
 
 	if dataOrder.Date != "" {
-		mb += fmt.Sprintf(" (%s)", dataOrder.Date)
+		title += fmt.Sprintf(" (%s)", dataOrder.Date)
 	}
-	mb += "*\n"
+
+	mb := newFormattedText(f).Bold(title).Text("\n")
 	if len(dataOrder.Items) > 0 {
-		mb += "\n"
+		mb.Text("\n")
 		for k, v := range dataOrder.Items {
-			mb += fmt.Sprintf(
+			mb.Text(fmt.Sprintf(
 				"%d. %s",
 				k+1,
-				replaceMarkdownSymbols(v.Name),
-			)
+				v.Name,
+			))
 
 			if v.Quantity != nil {
 				if v.Quantity.Value != 0 {
-					mb += fmt.Sprintf(
-						" _%v_",
-						v.Quantity.Value,
-					)
+					mb.Text(" ").Italic(fmt.Sprintf("%v", v.Quantity.Value))
 				}
 			}
 
 			if v.Price != nil {
 				if val, ok := currency[strings.ToLower(v.Price.Currency)]; ok {
-					mb += fmt.Sprintf(
-						" _x %s_\n",
-						getLocalizedTemplateMessage(
-							"cost_currency",
-							map[string]interface{}{
-								"Amount":   v.Price.Value,
-								"Currency": val,
-							},
-						),
-					)
+					mb.Text(" ").Italic("x " + getLocalizedTemplateMessage(
+						"cost_currency",
+						map[string]interface{}{
+							"Amount":   v.Price.Value,
+							"Currency": val,
+						},
+					)).Text("\n")
 				}
 			} else {
-				mb += "\n"
+				mb.Text("\n")
 			}
 		}
 	}
 
 	if dataOrder.Delivery != nil {
 		if dataOrder.Delivery.Name != "" {
-			mb += fmt.Sprintf(
-				"\n*%s:*\n%s",
-				getLocalizedMessage("delivery"),
-				replaceMarkdownSymbols(dataOrder.Delivery.Name),
-			)
+			mb.Text("\n").Bold(getLocalizedMessage("delivery") + ":").Text("\n" + dataOrder.Delivery.Name)
 		}
 
 		if dataOrder.Delivery.Price != nil {
 			if val, ok := currency[strings.ToLower(dataOrder.Delivery.Price.Currency)]; ok && dataOrder.Delivery.Price.Value != 0 {
-				mb += fmt.Sprintf(
+				mb.Text(fmt.Sprintf(
 					"; %s",
 					getLocalizedTemplateMessage(
 						"cost_currency",
@@ -868,32 +1165,29 @@ func getOrderMessage(dataOrder *v1.MessageDataOrder) string {
 							"Currency": val,
 						},
 					),
-				)
+				))
 			}
 		}
 
 		if dataOrder.Delivery.Address != "" {
-			mb += ";\n" + replaceMarkdownSymbols(dataOrder.Delivery.Address)
+			mb.Text(";\n" + dataOrder.Delivery.Address)
 		}
 
 		if dataOrder.Delivery.Comment != "" {
-			mb += ";\n" + replaceMarkdownSymbols(dataOrder.Delivery.Comment)
+			mb.Text(";\n" + dataOrder.Delivery.Comment)
 		}
 
-		mb += "\n"
+		mb.Text("\n")
 	}
 
 	if len(dataOrder.Payments) > 0 {
-		mb += fmt.Sprintf(
-			"\n*%s:*\n",
-			getLocalizedMessage("payment"),
-		)
+		mb.Text("\n").Bold(getLocalizedMessage("payment") + ":").Text("\n")
 		for _, v := range dataOrder.Payments {
-			mb += replaceMarkdownSymbols(v.Name)
+			mb.Text(v.Name)
 
 			if v.Amount != nil {
 				if val, ok := currency[strings.ToLower(v.Amount.Currency)]; ok && v.Amount.Value != 0 {
-					mb += fmt.Sprintf(
+					mb.Text(fmt.Sprintf(
 						"; %s",
 						getLocalizedTemplateMessage(
 							"cost_currency",
@@ -902,24 +1196,24 @@ func getOrderMessage(dataOrder *v1.MessageDataOrder) string {
 								"Currency": val,
 							},
 						),
-					)
+					))
 				}
 			}
 
 			if v.Status != nil && v.Status.Name != "" {
-				mb += fmt.Sprintf(
+				mb.Text(fmt.Sprintf(
 					" (%s)",
-					replaceMarkdownSymbols(v.Status.Name),
-				)
+					v.Status.Name,
+				))
 			}
 
-			mb += "\n"
+			mb.Text("\n")
 		}
 	}
 
 	if dataOrder.Cost != nil {
 		if val, ok := currency[strings.ToLower(dataOrder.Cost.Currency)]; ok && dataOrder.Cost.Value != 0 {
-			mb += fmt.Sprintf(
+			mb.Text(fmt.Sprintf(
 				"\n%s: %s",
 				getLocalizedMessage("order_total"),
 				getLocalizedTemplateMessage(
@@ -929,15 +1223,25 @@ func getOrderMessage(dataOrder *v1.MessageDataOrder) string {
 						"Currency": val,
 					},
 				),
-			)
+			))
 		}
 	}
 
 	return mb
 }
 
-func photoMessage(webhookData v1.WebhookData, mgClient *v1.MgClient, cid int64) (chattable tgbotapi.Chattable, err error) {
-	items := *webhookData.Items
+func photoMessage(webhookData v1.WebhookData, caption string, mgClient *v1.MgClient, cid int64) (chattable tgbotapi.Chattable, err error) {
+	var items []v1.FileItem
+	if webhookData.Items != nil {
+		items = *webhookData.Items
+	}
+
+	// Telegram downloads photos sent by URL itself and refuses large ones
+	for _, v := range items {
+		if err := checkFileSize(int64(v.Size), telegramPhotoURLLimit); err != nil {
+			return chattable, err
+		}
+	}
 
 	if len(items) == 1 {
 		v := items
@@ -950,7 +1254,7 @@ func photoMessage(webhookData v1.WebhookData, mgClient *v1.MgClient, cid int64)
 		msg := tgbotapi.NewPhotoUpload(cid, nil)
 		msg.FileID = file.Url
 		msg.UseExisting = true
-		msg.Caption = webhookData.Content
+		msg.Caption = caption
 
 		chattable = msg
 	} else if len(items) > 1 {
@@ -967,7 +1271,7 @@ func photoMessage(webhookData v1.WebhookData, mgClient *v1.MgClient, cid int64)
 			}
 
 			ip := tgbotapi.NewInputMediaPhoto(file.Url)
-			ip.Caption = webhookData.Content
+			ip.Caption = caption
 			it = append(it, ip)
 		}
 
@@ -977,53 +1281,74 @@ func photoMessage(webhookData v1.WebhookData, mgClient *v1.MgClient, cid int64)
 	return
 }
 
-func documentMessage(item v1.FileItem, mgClient *v1.MgClient, cid int64) (chattable tgbotapi.Chattable, err error) {
+func documentMessage(item v1.FileItem, msgType string, mgClient *v1.MgClient, cid int64) (chattable tgbotapi.Chattable, err error) {
+	if err := checkFileSize(int64(item.Size), telegramUploadLimit); err != nil {
+		return chattable, err
+	}
+
 	file, _, err := mgClient.GetFile(item.ID)
 	if err != nil {
 		return chattable, err
 	}
 
-	data, err := http.Get(file.Url)
+	// file is streamed from MG while it is uploaded to Telegram
+	tt := getFileReader(item.Caption, file.Url, int64(item.Size))
+
+	// Telegram shows media with player only for certain formats, so the type is chosen by file content
+	head, err := fetchFileHeader(file.Url)
 	if err != nil {
-		return chattable, err
+		logger.Errorf("fetchFileHeader fileID: %s, err: %s", item.ID, err.Error())
 	}
 
-	tt := tgbotapi.FileReader{
-		Name:   item.Caption,
-		Reader: data.Body,
-		Size:   int64(item.Size),
+	switch getFileMessageType(head, msgType) {
+	case "voice":
+		chattable = tgbotapi.NewVoiceUpload(cid, tt)
+	case "audio":
+		chattable = tgbotapi.NewAudioUpload(cid, tt)
+	case "video":
+		chattable = tgbotapi.NewVideoUpload(cid, tt)
+	default:
+		chattable = tgbotapi.NewDocumentUpload(cid, tt)
 	}
 
-	chattable = tgbotapi.NewDocumentUpload(cid, tt)
 	return
 }
 
-func textMessage(cid int64, mb string, quoteExternalID string) (chattable tgbotapi.Chattable, err error) {
-	var qid int
-	m := tgbotapi.NewMessage(cid, mb)
-
-	if quoteExternalID != "" {
-		qid, err = strconv.Atoi(quoteExternalID)
-		if err != nil {
-			return
-		}
-		m.ReplyToMessageID = qid
+// getFileMessageType chooses Telegram method for file by its header so that media is shown with player,
+// voice messages must be OGG encoded with Opus
+func getFileMessageType(head []byte, msgType string) string {
+	kind, _ := filetype.Match(head)
+
+	switch {
+	case kind == filetypes.TypeOgg && bytes.Contains(head, []byte("OpusHead")):
+		return "voice"
+	case kind == filetypes.TypeMp3 || kind == filetypes.TypeM4a:
+		return "audio"
+	case kind == filetypes.TypeMp4:
+		return "video"
+	case msgType == v1.MsgTypeAudio:
+		return "audio"
+	default:
+		return "document"
 	}
+}
 
-	m.ParseMode = "Markdown"
+func textMessage(cid int64, mb string, quoteID int, parseMode string) tgbotapi.Chattable {
+	m := tgbotapi.NewMessage(cid, mb)
+	m.ReplyToMessageID = quoteID
+	m.ParseMode = parseMode
 
-	chattable = m
-	return
+	return m
 }
 
-func setAttachment(attachments *tgbotapi.Message, client *v1.MgClient, snd *v1.SendData, botToken string) error {
+func setAttachment(attachments *Message, client *v1.MgClient, snd *v1.SendData, b *Bot) error {
 	var (
 		items  []v1.Item
 		fileID string
 	)
 
 	t := getMessageID(attachments)
-	bot, err := tgbotapi.NewBotAPI(botToken)
+	bot, err := getBotAPI(b)
 	if err != nil {
 		return err
 	}
@@ -1037,7 +1362,7 @@ func setAttachment(attachments *tgbotapi.Message, client *v1.MgClient, snd *v1.S
 		}
 
 		snd.Message.Type = v1.MsgTypeImage
-		snd.Message.Note = attachments.Caption
+		snd.Message.Note = getCaptionText(attachments)
 	case "animation":
 		fileID = attachments.Animation.FileID
 		snd.Message.Type = v1.MsgTypeFile
@@ -1047,25 +1372,58 @@ func setAttachment(attachments *tgbotapi.Message, client *v1.MgClient, snd *v1.S
 		snd.Message.Type = v1.MsgTypeFile
 		caption = attachments.Document.FileName
 	case "sticker":
-		fileID = attachments.Sticker.FileID
-		snd.Message.Type = v1.MsgTypeImage
+		return setStickerAttachment(attachments.Sticker, client, snd, bot)
 	case "voice":
 		fileID = attachments.Voice.FileID
 		snd.Message.Type = v1.MsgTypeAudio
+	case "video":
+		fileID = attachments.Video.FileID
+		snd.Message.Type = v1.MsgTypeFile
+	case "video_note":
+		fileID = attachments.VideoNote.FileID
+		snd.Message.Type = v1.MsgTypeFile
+	case "audio":
+		fileID = attachments.Audio.FileID
+		snd.Message.Type = v1.MsgTypeFile
+		caption = getAudioTitle(attachments.Audio)
+	case "location", "venue", "poll":
+		snd.Message.Text = getStructuredMessageText(attachments, t)
+	case "contact":
+		snd.Message.Text = getStructuredMessageText(attachments, t)
+
+		// customer shared own phone number
+		if attachments.From != nil && attachments.Contact.UserID == attachments.From.ID {
+			snd.Customer.Phone = attachments.Contact.PhoneNumber
+		}
 	default:
 		snd.Message.Text = getLocalizedMessage(t)
 	}
 
 	if fileID != "" {
 		file, err := getFileURL(fileID, bot)
+		if isFileTooBigError(err) {
+			// operator is told about the file instead of the message being lost
+			snd.Message.Type = v1.MsgTypeText
+			snd.Message.Note = ""
+			snd.Message.Text = getLocalizedTemplateMessage(
+				"file_too_large_download",
+				map[string]interface{}{"Limit": telegramDownloadLimit >> 20},
+			)
+			if text := getCaptionText(attachments); text != "" {
+				snd.Message.Text += "\n\n" + text
+			}
+
+			return nil
+		}
+
 		if err != nil {
 			return err
 		}
 
 		item := v1.Item{}
-		fileUrl := fmt.Sprintf("https://api.telegram.org/file/bot%s/%s", botToken, file.FilePath)
+		fileUrl := getTelegramFileURL(bot, file)
 		switch {
-		case t == "sticker" || t == "voice":
+		case t == "voice":
 			item, _, err = getItemData(
 				client,
 				fileUrl,
@@ -1085,6 +1443,21 @@ func setAttachment(attachments *tgbotapi.Message, client *v1.MgClient, snd *v1.S
 			}
 
 			item.Caption = item.ID + ".mp4"
+		case t == "video" || t == "video_note" || t == "audio":
+			item, _, err = getItemData(
+				client,
+				fileUrl,
+				caption,
+			)
+			if err != nil {
+				return err
+			}
+
+			if item.Caption == "" {
+				item.Caption = item.ID
+			}
+
+			item.Caption += path.Ext(file.FilePath)
 		default:
 			item, err = convertAndUploadImage(
 				client,
@@ -1100,12 +1473,22 @@ func setAttachment(attachments *tgbotapi.Message, client *v1.MgClient, snd *v1.S
 
 	if len(items) > 0 {
 		snd.Message.Items = items
-		snd.Message.Text = attachments.Caption
+		snd.Message.Text = getCaptionText(attachments)
 	}
 
 	return nil
 }
 
+// getAudioTitle returns name of audio file as shown in Telegram
+func getAudioTitle(audio *tgbotapi.Audio) string {
+	switch {
+	case audio.Performer != "" && audio.Title != "":
+		return audio.Performer + " - " + audio.Title
+	default:
+		return audio.Title
+	}
+}
+
 func getItemData(client *v1.MgClient, url string, caption string) (v1.Item, int, error) {
 	item := v1.Item{}
 
@@ -1128,51 +1511,57 @@ func getFileURL(fileID string, b *tgbotapi.BotAPI) (tgbotapi.File, error) {
 	return b.GetFile(tgbotapi.FileConfig{FileID: fileID})
 }
 
+// getTelegramFileURL returns URL file can be downloaded by, it contains bot token and must not be shown to anyone
+func getTelegramFileURL(b *tgbotapi.BotAPI, file tgbotapi.File) string {
+	return fmt.Sprintf("https://api.telegram.org/file/bot%s/%s", b.Token, file.FilePath)
+}
+
+// convertAndUploadImage streams image from Telegram to MG, WebP is converted to PNG on the fly
 func convertAndUploadImage(client *v1.MgClient, url string) (v1.Item, error) {
 	item := v1.Item{}
 
-	res, err := http.Get(url)
+	body, err := fetchFile(url, telegramDownloadLimit)
 	if err != nil {
 		return item, err
 	}
+	defer body.Close()
 
-	imgByte, err := ioutil.ReadAll(res.Body)
-	if err != nil {
+	// file type is detected by the header, the rest of the file is not read in memory
+	r := bufio.NewReaderSize(body, fileHeaderSize)
+	head, err := r.Peek(fileHeaderSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
 		return item, err
 	}
 
-	if kind, err := filetype.Match(imgByte); err != nil {
+	var upload io.Reader = r
+
+	if kind, err := filetype.Match(head); err != nil {
 		return item, err
 	} else if kind == filetypes.TypeWebp {
-		img, err := webp.Decode(res.Body)
-		if err != nil {
-			return item, err
-		}
-
 		pReader, pWriter := io.Pipe()
+		converted := make(chan struct{})
 
 		go func() {
-			defer pWriter.Close()
-			err = png.Encode(pWriter, img)
-			if err != nil {
-				logger.Info(item, err.Error())
-			}
+			pWriter.CloseWithError(convertWebPToPNG(pWriter, r))
+			close(converted)
 		}()
 
-		data, _, err := client.UploadFile(pReader)
-		if err != nil {
-			return item, err
-		}
+		// conversion is stopped when upload ends without reading the whole image,
+		// the source is closed only after the conversion is done with it
+		defer func() {
+			pReader.CloseWithError(io.ErrClosedPipe)
+			<-converted
+		}()
 
-		item.ID = data.ID
-	} else {
-		data, _, err := client.UploadFile(bytes.NewReader(imgByte))
-		if err != nil {
-			return item, err
-		}
+		upload = pReader
+	}
 
-		item.ID = data.ID
+	data, _, err := client.UploadFile(upload)
+	if err != nil {
+		return item, err
 	}
 
+	item.ID = data.ID
+
 	return item, nil
 }
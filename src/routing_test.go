@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -8,11 +9,14 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"runtime"
 	"strings"
 	"testing"
 
 	"github.com/gin-gonic/gin"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/h2non/gock"
+	v1 "github.com/retailcrm/mg-transport-api-client-go/v1"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -23,6 +27,10 @@ var ch = getChannelSettings()
 func init() {
 	os.Chdir("../")
 	config = LoadConfig("config.yml")
+	if config.HTTPServer.SessionSecret == "" {
+		config.HTTPServer.SessionSecret = "secret"
+	}
+	initSessionSecret()
 	orm = NewDb(config)
 	logger = newLogger()
 	router = setup()
@@ -37,7 +45,55 @@ func init() {
 	}
 
 	c.createConnection()
-	orm.DB.Delete(Bot{}, "token = ?", "123123:Qwerty")
+	orm.DB.Delete(Bot{}, "token_hash = ?", secretHash("123123:Qwerty"))
+}
+
+// testMGURL is MG endpoint stubbed by gock in tests
+const testMGURL = "https://mg.example.com"
+
+// createTestBot saves bot of the test connection and registers its Bot API client intercepted by gock,
+// the bot is removed by deleteTestBot
+func createTestBot(t *testing.T, b *Bot) *tgbotapi.BotAPI {
+	b.ConnectionID = 1
+	require.NoError(t, orm.DB.Create(b).Error)
+
+	api := &tgbotapi.BotAPI{Token: string(b.Token), Client: &http.Client{}}
+	gock.InterceptClient(api.Client)
+	botAPIs.mu.Lock()
+	botAPIs.bots[b.ID] = &botClient{token: string(b.Token), api: api}
+	botAPIs.mu.Unlock()
+
+	return api
+}
+
+func deleteTestBot(b *Bot) {
+	botAPIs.remove(b.ID)
+	orm.DB.Delete(b)
+}
+
+func newTestMGClient() *v1.MgClient {
+	return v1.New(testMGURL, "token")
+}
+
+// newSessionRequest creates request authorized by the session started with signed settings link
+func newSessionRequest(t *testing.T, method, url, body string) *http.Request {
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", getAccountPath("123123"), nil))
+	require.Equal(t, http.StatusFound, rr.Code)
+
+	cookies := rr.Result().Cookies()
+	require.NotEmpty(t, cookies)
+	assert.Equal(t, http.SameSiteLaxMode, cookies[0].SameSite)
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.AddCookie(cookies[0])
+	req.Header.Set("X-CSRF-Token", getCSRFToken(cookies[0].Value))
+
+	return req
 }
 
 func TestRouting_connectHandler(t *testing.T) {
@@ -59,7 +115,6 @@ func TestRouting_addBotHandler(t *testing.T) {
 	ch.Name = "@TestBot"
 
 	outgoing, _ := json.Marshal(ch)
-	p := url.Values{"url": {"https://" + config.HTTPServer.Host + "/telegram/123123:Qwerty"}}
 
 	gock.New("https://api.telegram.org").
 		Post("/bot123123:Qwerty/getMe").
@@ -69,15 +124,10 @@ func TestRouting_addBotHandler(t *testing.T) {
 	gock.New("https://api.telegram.org").
 		Post("/bot123123:Qwerty/setWebhook").
 		MatchType("url").
-		BodyString(p.Encode()).
+		BodyString(`secret_token=[0-9a-f]{64}&url=https%3A%2F%2F.+%2Ftelegram%2F[0-9a-f]{64}`).
 		Reply(201).
 		BodyString(`{"ok":true}`)
 
-	gock.New("https://api.telegram.org").
-		Post("/bot123123:Qwerty/getWebhookInfo").
-		Reply(200).
-		BodyString(`{"ok":true,"result":{"url":"https://` + config.HTTPServer.Host + `/telegram/123123:Qwerty","has_custom_certificate":false,"pending_update_count":0}}`)
-
 	gock.New("https://test.retailcrm.pro").
 		Post("/api/transport/v1/channels").
 		JSON([]byte(outgoing)).
@@ -86,10 +136,7 @@ func TestRouting_addBotHandler(t *testing.T) {
 		Reply(201).
 		BodyString(`{"id": 1}`)
 
-	req, err := http.NewRequest("POST", "/add-bot/", strings.NewReader(`{"token": "123123:Qwerty", "connectionId": 1}`))
-	if err != nil {
-		t.Fatal(err)
-	}
+	req := newSessionRequest(t, "POST", "/add-bot/", `{"token": "123123:Qwerty", "connectionId": 1}`)
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
 	require.Equal(t, http.StatusCreated, rr.Code,
@@ -110,6 +157,55 @@ func TestRouting_addBotHandler(t *testing.T) {
 	assert.Equal(t, "123123:Qwerty", res["token"])
 }
 
+func TestRouting_telegramWebhookHandler_WrongSecret(t *testing.T) {
+	b, err := getBotByToken("123123:Qwerty")
+	require.NoError(t, err)
+	require.NotEmpty(t, b.WebhookID)
+
+	req, err := http.NewRequest("POST", "/telegram/"+b.WebhookID, strings.NewReader(`{"update_id": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("X-Telegram-Bot-Api-Secret-Token", "wrong")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code,
+		fmt.Sprintf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized))
+}
+
+func TestRouting_telegramWebhookHandler_LegacyURL(t *testing.T) {
+	b, err := getBotByToken("123123:Qwerty")
+	require.NoError(t, err)
+	require.True(t, b.WebhookMigrated)
+
+	req, err := http.NewRequest("POST", "/telegram/123123:Qwerty", strings.NewReader(`{"update_id": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code,
+		fmt.Sprintf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized))
+}
+
+func TestRouting_deleteBotHandler_WithoutSession(t *testing.T) {
+	req, err := http.NewRequest("POST", "/delete-bot/", strings.NewReader(`{"token": "123123:Qwerty", "connectionId": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code,
+		fmt.Sprintf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized))
+}
+
 func TestRouting_deleteBotHandler(t *testing.T) {
 	defer gock.Off()
 
@@ -121,11 +217,7 @@ func TestRouting_deleteBotHandler(t *testing.T) {
 		Reply(200).
 		BodyString(`{"id": 1}`)
 
-	req, err := http.NewRequest("POST", "/delete-bot/", strings.NewReader(`{"token": "123123:Qwerty", "active": false, "connectionId": 1}`))
-	if err != nil {
-		t.Fatal(err)
-	}
-
+	req := newSessionRequest(t, "POST", "/delete-bot/", `{"token": "123123:Qwerty", "active": false, "connectionId": 1}`)
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
 
@@ -134,10 +226,7 @@ func TestRouting_deleteBotHandler(t *testing.T) {
 }
 
 func TestRouting_settingsHandler(t *testing.T) {
-	req, err := http.NewRequest("GET", "/settings/123123", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
+	req := newSessionRequest(t, "GET", "/settings/123123", "")
 
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
@@ -146,6 +235,22 @@ func TestRouting_settingsHandler(t *testing.T) {
 		fmt.Sprintf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK))
 }
 
+func TestRouting_settingsHandler_WithoutSignature(t *testing.T) {
+	for _, url := range []string{"/settings/123123", "/settings/123123?sign=wrong"} {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusFound, rr.Code, url)
+		assert.Equal(t, "/", rr.Header().Get("Location"), url)
+		assert.Empty(t, rr.Result().Cookies(), url)
+	}
+}
+
 func TestRouting_saveHandler(t *testing.T) {
 	defer gock.Off()
 
@@ -154,15 +259,11 @@ func TestRouting_saveHandler(t *testing.T) {
 		Reply(200).
 		BodyString(`{"success": true, "credentials": ["/api/integration-modules/{code}", "/api/integration-modules/{code}/edit"]}`)
 
-	req, err := http.NewRequest("POST", "/save/",
-		strings.NewReader(
-			`{"clientId": "123123", 
+	req := newSessionRequest(t, "POST", "/save/",
+		`{"clientId": "123123", 
 			"api_url": "https://test.retailcrm.ru",
 			"api_key": "test"}`,
-		))
-	if err != nil {
-		t.Fatal(err)
-	}
+	)
 
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
@@ -189,3 +290,80 @@ func TestRouting_activityHandler(t *testing.T) {
 	assert.Equal(t, http.StatusOK, rr.Code,
 		fmt.Sprintf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK))
 }
+
+// oggOpusHeader is the beginning of OGG file with Opus stream
+var oggOpusHeader = append(append([]byte("OggS"), make([]byte, 24)...), "OpusHead"...)
+
+func TestRouting_getFileMessageType(t *testing.T) {
+	oggVorbis := append(append([]byte("OggS"), make([]byte, 25)...), "vorbis"...)
+	mp3 := []byte("ID3\x03\x00\x00\x00")
+	m4a := []byte("\x00\x00\x00\x20ftypM4A \x00\x00\x00\x00")
+	mp4 := []byte("\x00\x00\x00\x20ftypisom\x00\x00\x02\x00")
+
+	assert.Equal(t, "voice", getFileMessageType(oggOpusHeader, v1.MsgTypeAudio))
+	assert.Equal(t, "voice", getFileMessageType(oggOpusHeader, v1.MsgTypeFile))
+	assert.Equal(t, "audio", getFileMessageType(oggVorbis, v1.MsgTypeAudio))
+	assert.Equal(t, "document", getFileMessageType(oggVorbis, v1.MsgTypeFile))
+	assert.Equal(t, "audio", getFileMessageType(mp3, v1.MsgTypeFile))
+	assert.Equal(t, "audio", getFileMessageType(m4a, v1.MsgTypeFile))
+	assert.Equal(t, "video", getFileMessageType(mp4, v1.MsgTypeFile))
+	assert.Equal(t, "audio", getFileMessageType(nil, v1.MsgTypeAudio))
+	assert.Equal(t, "document", getFileMessageType([]byte("%PDF-1.4"), v1.MsgTypeFile))
+}
+
+func TestRouting_documentMessage_Audio(t *testing.T) {
+	defer gock.Off()
+
+	mgClient := newTestMGClient()
+
+	// type is taken from the content, not from the name
+	gock.New(testMGURL).
+		Get("/files/voice").
+		Reply(200).
+		BodyString(`{"id":"voice","type":"audio","size":100,"url":"https://files.example.com/voice"}`)
+	gock.New("https://files.example.com").
+		Get("/voice").
+		MatchHeader("Range", "bytes=0-261").
+		Reply(206).
+		Body(bytes.NewReader(oggOpusHeader))
+
+	m, err := documentMessage(v1.FileItem{ID: "voice", Size: 100, Caption: "voice.mp3"}, v1.MsgTypeAudio, mgClient, 123)
+	require.NoError(t, err)
+	assert.IsType(t, tgbotapi.VoiceConfig{}, m)
+
+	gock.New(testMGURL).
+		Get("/files/song").
+		Reply(200).
+		BodyString(`{"id":"song","type":"audio","size":100,"url":"https://files.example.com/song"}`)
+	gock.New("https://files.example.com").
+		Get("/song").
+		Reply(206).
+		BodyString("ID3\x03\x00\x00\x00")
+
+	m, err = documentMessage(v1.FileItem{ID: "song", Size: 100, Caption: "song.ogg"}, v1.MsgTypeAudio, mgClient, 123)
+	require.NoError(t, err)
+	assert.IsType(t, tgbotapi.AudioConfig{}, m)
+	assert.True(t, gock.IsDone())
+}
+
+func TestRouting_convertAndUploadImage_UploadFailed(t *testing.T) {
+	defer gock.Off()
+
+	gock.New("https://files.example.com").
+		Get("/sticker.webp").
+		Reply(200).
+		Body(bytes.NewReader(readStickerFixture(t, "static.webp")))
+	gock.New(testMGURL).
+		Post("/files/upload").
+		Reply(500).
+		BodyString(`{"errors":["upload failed"]}`)
+
+	before := runtime.NumGoroutine()
+
+	_, err := convertAndUploadImage(newTestMGClient(), "https://files.example.com/sticker.webp")
+	assert.Error(t, err)
+
+	// conversion does not outlive the upload
+	assert.True(t, runtime.NumGoroutine() <= before)
+	assert.True(t, gock.IsDone())
+}
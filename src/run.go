@@ -1,9 +1,12 @@
 package main
 
 import (
+	"crypto/subtle"
+	"errors"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/getsentry/raven-go"
@@ -27,16 +30,36 @@ type RunCommand struct{}
 // Execute command
 func (x *RunCommand) Execute(args []string) error {
 	config = LoadConfig(options.Config)
+	if err := initSessionSecret(); err != nil {
+		return err
+	}
+
 	orm = NewDb(config)
 	logger = newLogger()
 
+	if getStorage() == nil {
+		return errors.New("storage is not configured")
+	}
+
 	go start()
+	go migrateWebhooks()
+	go updateIntegrationModules()
+	inbound := startInboundQueue()
+	outbound := startOutboundQueue()
+	polling := startPolling()
+	cacheListener := startCacheListener()
+	reconciliation := startReconciliation()
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c)
 	for sig := range c {
 		switch sig {
 		case os.Interrupt, syscall.SIGQUIT, syscall.SIGTERM:
+			reconciliation.Stop()
+			cacheListener.Stop()
+			polling.Stop()
+			inbound.Stop()
+			outbound.Stop()
 			orm.DB.Close()
 			return nil
 		default:
@@ -54,7 +77,6 @@ func start() {
 func setup() *gin.Engine {
 	loadTranslateFile()
 	setValidation()
-	updateChannelsSettings()
 
 	if config.Debug == false {
 		gin.SetMode(gin.ReleaseMode)
@@ -67,6 +89,7 @@ func setup() *gin.Engine {
 	}
 
 	r.Static("/static", "./static")
+	setStorageRoutes(r)
 	r.HTMLRender = createHTMLRender()
 
 	r.Use(func(c *gin.Context) {
@@ -87,13 +110,16 @@ func setup() *gin.Engine {
 
 	r.GET("/", checkAccountForRequest(), connectHandler)
 	r.Any("/settings/:uid", settingsHandler)
-	r.POST("/save/", checkConnectionForRequest(), saveHandler)
+	r.POST("/save/", checkSession(), checkConnectionForRequest(), saveHandler)
 	r.POST("/create/", checkConnectionForRequest(), createHandler)
-	r.POST("/add-bot/", checkBotForRequest(), addBotHandler)
-	r.POST("/delete-bot/", checkBotForRequest(), deleteBotHandler)
-	r.POST("/set-lang/", checkBotForRequest(), setLangBotHandler)
+	r.POST("/add-bot/", checkSession(), checkBotForRequest(), addBotHandler)
+	r.POST("/delete-bot/", checkSession(), checkBotForRequest(), deleteBotHandler)
+	r.POST("/set-lang/", checkSession(), checkBotForRequest(), setLangBotHandler)
+	r.POST("/set-group-mode/", checkSession(), checkBotForRequest(), setGroupModeBotHandler)
+	r.POST("/set-update-mode/", checkSession(), checkBotForRequest(), setUpdateModeBotHandler)
 	r.POST("/actions/activity", activityHandler)
-	r.POST("/telegram/:token", checkBotForWebhook(), telegramWebhookHandler)
+	r.POST("/telegram/:id", checkBotForWebhook(), telegramWebhookHandler)
+	r.GET("/avatar/:bot/:user/:sig", avatarHandler)
 	r.POST("/webhook/", checkConnectionForWebhook(), mgWebhookHandler)
 
 	return r
@@ -131,6 +157,13 @@ func checkBotForRequest() gin.HandlerFunc {
 			return
 		}
 
+		session := c.MustGet("session").(Connection)
+		if b.ConnectionID != 0 && b.ConnectionID != session.ID {
+			c.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse{Error: getLocalizedMessage("wrong_data")})
+			return
+		}
+
+		b.ConnectionID = session.ID
 		c.Set("bot", b)
 	}
 }
@@ -145,6 +178,12 @@ func checkConnectionForRequest() gin.HandlerFunc {
 		}
 
 		conn.APIURL = rx.ReplaceAllString(conn.APIURL, ``)
+
+		if session, ok := c.Get("session"); ok && session.(Connection).ClientID != conn.ClientID {
+			c.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse{Error: getLocalizedMessage("wrong_data")})
+			return
+		}
+
 		c.Set("connection", conn)
 	}
 }
@@ -157,7 +196,7 @@ func checkConnectionForWebhook() gin.HandlerFunc {
 			return
 		}
 
-		conn := getConnection(clientID)
+		conn := getCachedConnection(clientID)
 		if !conn.Active {
 			c.AbortWithStatus(http.StatusBadRequest)
 			return
@@ -169,19 +208,94 @@ func checkConnectionForWebhook() gin.HandlerFunc {
 
 func checkBotForWebhook() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		token := c.Param("token")
-
-		b, err := getBotByToken(token)
-		if err != nil {
-			c.Error(err)
+		id := c.Param("id")
+
+		// bots added before webhook secrets have the token in webhook URL,
+		// it is accepted only until the webhook is moved to the new URL on startup
+		if strings.Contains(id, ":") {
+			b, err := getBotByToken(EncryptedString(id))
+			if err != nil {
+				c.Error(err)
+				return
+			}
+
+			if b.ID == 0 {
+				c.AbortWithStatus(http.StatusOK)
+				return
+			}
+
+			if b.WebhookMigrated {
+				c.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+
+			c.Set("bot", *b)
 			return
 		}
 
+		b := getBotByWebhookID(id)
 		if b.ID == 0 {
 			c.AbortWithStatus(http.StatusOK)
 			return
 		}
 
+		secret := c.GetHeader("X-Telegram-Bot-Api-Secret-Token")
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(b.WebhookSecret)) != 1 {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
 		c.Set("bot", *b)
 	}
 }
+
+// migrateWebhooks moves webhooks of bots added before webhook secrets to the URL with opaque identifier
+// and secret, webhooks of bots in polling mode are removed
+func migrateWebhooks() {
+	for _, b := range getBotsWithLegacyWebhook() {
+		bot, err := getBotAPI(&b)
+		if err == nil {
+			if b.getUpdateMode() == UpdateModePolling {
+				_, err = bot.RemoveWebhook()
+			} else {
+				_, err = setWebhook(bot, &b)
+			}
+		}
+
+		if err == nil {
+			err = b.setWebhookMigrated()
+		}
+
+		if err != nil {
+			logger.Errorf("migrateWebhooks bot %d: %s", b.ID, err.Error())
+		}
+	}
+}
+
+// updateIntegrationModules registers integration module in retailCRM again when its settings link changed
+// with the host or the session secret, so that the link keeps starting settings sessions
+func updateIntegrationModules() {
+	for _, conn := range getConnections() {
+		moduleHash := getIntegrationModuleHash(conn.ClientID)
+		if !conn.Active || conn.ModuleHash == moduleHash {
+			continue
+		}
+
+		if err := updateIntegrationModule(conn, moduleHash); err != nil {
+			logger.Errorf("updateIntegrationModules apiURL: %s, err: %s", conn.APIURL, err.Error())
+		}
+	}
+}
+
+func updateIntegrationModule(conn *Connection, moduleHash string) error {
+	data, status, f := getCRMClient(conn).IntegrationModuleEdit(getIntegrationModule(conn.ClientID))
+	if err := failureError(f); err != nil {
+		return err
+	}
+
+	if status >= http.StatusBadRequest || !data.Success {
+		return errors.New(http.StatusText(status))
+	}
+
+	return conn.setModuleHash(moduleHash)
+}
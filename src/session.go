@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	sessionCookieName = "mg_telegram_session"
+	csrfHeaderName    = "X-CSRF-Token"
+	// accountSignParam carries signature of the settings link given to retailCRM
+	accountSignParam = "sign"
+)
+
+var (
+	sessionSecret []byte
+
+	errSessionInvalid       = errors.New("invalid session")
+	errSessionExpired       = errors.New("session expired")
+	errSessionSecretMissing = errors.New("http_server.session_secret is not configured")
+)
+
+// setSessionSecret initializes the key signing settings sessions and links, it must be the same on all replicas
+func setSessionSecret(secret string) {
+	sessionSecret = []byte(secret)
+}
+
+// initSessionSecret sets the key from config, it is done before anything signs sessions or links
+func initSessionSecret() error {
+	if config.HTTPServer.SessionSecret == "" {
+		return errSessionSecretMissing
+	}
+
+	setSessionSecret(config.HTTPServer.SessionSecret)
+
+	return nil
+}
+
+func getSessionLifetime() time.Duration {
+	if config.HTTPServer.SessionLifetime > 0 {
+		return time.Duration(config.HTTPServer.SessionLifetime) * time.Second
+	}
+
+	return time.Hour
+}
+
+func sign(data string) string {
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write([]byte(data))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// getAccountSignature signs settings link of the connection, only retailCRM and the transport know it
+func getAccountSignature(clientID string) string {
+	return sign("account|" + clientID)
+}
+
+// getAccountPath returns settings link which starts a session
+func getAccountPath(clientID string) string {
+	return "/settings/" + clientID + "?" + accountSignParam + "=" + getAccountSignature(clientID)
+}
+
+func isAccountSignatureValid(clientID, signature string) bool {
+	return signature != "" && hmac.Equal([]byte(signature), []byte(getAccountSignature(clientID)))
+}
+
+// issueSession returns signed token granting access to connection settings until it expires
+func issueSession(clientID string) string {
+	payload := base64.RawURLEncoding.EncodeToString(
+		[]byte(fmt.Sprintf("%s|%d", clientID, time.Now().Add(getSessionLifetime()).Unix())),
+	)
+
+	return payload + "." + sign(payload)
+}
+
+// parseSession verifies session token and returns client ID of the connection
+func parseSession(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(sign(parts[0]))) {
+		return "", errSessionInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", errSessionInvalid
+	}
+
+	data := strings.Split(string(payload), "|")
+	if len(data) != 2 {
+		return "", errSessionInvalid
+	}
+
+	expires, err := strconv.ParseInt(data[1], 10, 64)
+	if err != nil {
+		return "", errSessionInvalid
+	}
+
+	if time.Now().Unix() > expires {
+		return "", errSessionExpired
+	}
+
+	return data[0], nil
+}
+
+// getCSRFToken derives CSRF token bound to the session
+func getCSRFToken(session string) string {
+	return sign("csrf|" + session)
+}
+
+// startSession sets session cookie, it is issued only for a signed settings link
+func startSession(c *gin.Context, clientID string) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    issueSession(clientID),
+		Path:     "/",
+		MaxAge:   int(getSessionLifetime().Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// getSession returns session cookie if it is valid for the connection
+func getSession(c *gin.Context, clientID string) (string, bool) {
+	session, err := c.Cookie(sessionCookieName)
+	if err != nil {
+		return "", false
+	}
+
+	id, err := parseSession(session)
+
+	return session, err == nil && id == clientID
+}
+
+// checkSession allows request only with valid session cookie and CSRF header
+func checkSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, err := c.Cookie(sessionCookieName)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: getLocalizedMessage("session_expired")})
+			return
+		}
+
+		clientID, err := parseSession(session)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: getLocalizedMessage("session_expired")})
+			return
+		}
+
+		csrf := c.GetHeader(csrfHeaderName)
+		if subtle.ConstantTimeCompare([]byte(csrf), []byte(getCSRFToken(session))) != 1 {
+			c.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse{Error: getLocalizedMessage("session_expired")})
+			return
+		}
+
+		conn := getConnection(clientID)
+		if conn.ID == 0 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: getLocalizedMessage("session_expired")})
+			return
+		}
+
+		c.Set("session", *conn)
+	}
+}
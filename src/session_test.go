@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession_accountSignature(t *testing.T) {
+	defer func(secret []byte) { sessionSecret = secret }(sessionSecret)
+	setSessionSecret("secret")
+
+	sig := getAccountSignature("123123")
+	assert.True(t, isAccountSignatureValid("123123", sig))
+	assert.False(t, isAccountSignatureValid("123124", sig))
+	assert.False(t, isAccountSignatureValid("123123", ""))
+	assert.Equal(t, "/settings/123123?sign="+sig, getAccountPath("123123"))
+
+	setSessionSecret("other")
+	assert.False(t, isAccountSignatureValid("123123", sig))
+}
+
+func TestSession_initSessionSecret(t *testing.T) {
+	defer func(secret []byte, c *TransportConfig) { sessionSecret, config = secret, c }(sessionSecret, config)
+	config = &TransportConfig{}
+	setSessionSecret("")
+
+	assert.Equal(t, errSessionSecretMissing, initSessionSecret())
+
+	config.HTTPServer.SessionSecret = "secret"
+	assert.NoError(t, initSessionSecret())
+	assert.Equal(t, []byte("secret"), sessionSecret)
+}
+
+func TestSession_parseSession(t *testing.T) {
+	defer func(secret []byte, c *TransportConfig) { sessionSecret, config = secret, c }(sessionSecret, config)
+	setSessionSecret("secret")
+	config = &TransportConfig{}
+
+	clientID, err := parseSession(issueSession("123123"))
+	assert.NoError(t, err)
+	assert.Equal(t, "123123", clientID)
+
+	_, err = parseSession(issueSession("123123") + "x")
+	assert.Equal(t, errSessionInvalid, err)
+
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("123123|%d", time.Now().Add(-time.Second).Unix())))
+	_, err = parseSession(payload + "." + sign(payload))
+	assert.Equal(t, errSessionExpired, err)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/h2non/filetype"
+	filetypes "github.com/h2non/filetype/matchers"
+	v1 "github.com/retailcrm/mg-transport-api-client-go/v1"
+	"golang.org/x/image/webp"
+)
+
+const (
+	// stickerStatic is WebP image
+	stickerStatic = "static"
+	// stickerAnimated is Lottie animation in gzipped .tgs file, operator gets its thumbnail
+	stickerAnimated = "animated"
+	// stickerVideo is .webm video, operator gets it as a file
+	stickerVideo = "video"
+
+	// maxStickerSize bounds sticker downloaded from Telegram, stickers are much smaller
+	maxStickerSize = 1 << 20
+)
+
+var (
+	errNoStickerPreview   = errors.New("sticker has no thumbnail")
+	errUnknownStickerType = errors.New("unknown sticker file type")
+)
+
+// Sticker is sticker with fields added in later Bot API versions
+type Sticker struct {
+	tgbotapi.Sticker
+	IsAnimated bool                `json:"is_animated"`
+	IsVideo    bool                `json:"is_video"`
+	Thumb      *tgbotapi.PhotoSize `json:"thumbnail"`
+}
+
+// getThumbnail returns sticker thumbnail, Bot API renamed the field so both names are checked
+func (s *Sticker) getThumbnail() *tgbotapi.PhotoSize {
+	if s.Thumb != nil {
+		return s.Thumb
+	}
+
+	return s.Thumbnail
+}
+
+// getStickerFormat returns format of the sticker by its flags, extension of the file is used
+// when update was sent by Bot API version which has no flags
+func getStickerFormat(s *Sticker, filePath string) string {
+	switch {
+	case s.IsVideo:
+		return stickerVideo
+	case s.IsAnimated:
+		return stickerAnimated
+	}
+
+	switch strings.ToLower(path.Ext(filePath)) {
+	case ".webm":
+		return stickerVideo
+	case ".tgs":
+		return stickerAnimated
+	default:
+		return stickerStatic
+	}
+}
+
+// detectStickerFormat returns format of the sticker file by its content, empty string if it is not a sticker
+func detectStickerFormat(data []byte) string {
+	switch {
+	case filetypes.Webm(data):
+		return stickerVideo
+	case isTGS(data):
+		return stickerAnimated
+	case filetype.IsImage(data):
+		return stickerStatic
+	default:
+		return ""
+	}
+}
+
+// isTGS returns true if data is gzipped Lottie animation Telegram uses for animated stickers
+func isTGS(data []byte) bool {
+	if !filetypes.Gz(data) {
+		return false
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+
+	var lottie struct {
+		TGS    int `json:"tgs"`
+		Width  int `json:"w"`
+		Height int `json:"h"`
+	}
+
+	if err := json.NewDecoder(io.LimitReader(r, maxStickerSize)).Decode(&lottie); err != nil {
+		return false
+	}
+
+	return lottie.TGS == 1 && lottie.Width > 0 && lottie.Height > 0
+}
+
+// convertWebPToPNG writes WebP image as PNG which is shown by every operator client
+func convertWebPToPNG(w io.Writer, r io.Reader) error {
+	img, err := webp.Decode(r)
+	if err != nil {
+		return err
+	}
+
+	return png.Encode(w, img)
+}
+
+// getStickerImage returns sticker image ready for upload to MG, WebP is converted to PNG
+func getStickerImage(data []byte) ([]byte, error) {
+	kind, err := filetype.Match(data)
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case filetypes.TypeWebp:
+		var buf bytes.Buffer
+		if err := convertWebPToPNG(&buf, bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	case filetypes.TypePng, filetypes.TypeJpeg:
+		return data, nil
+	default:
+		return nil, errUnknownStickerType
+	}
+}
+
+func downloadSticker(url string) ([]byte, error) {
+	body, err := fetchFile(url, maxStickerSize)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return ioutil.ReadAll(body)
+}
+
+// uploadSticker uploads sticker to MG and returns the item with type of the message it must be sent in,
+// static stickers become PNG images, animated ones are shown by thumbnail and video ones are sent as files
+func uploadSticker(client *v1.MgClient, bot *tgbotapi.BotAPI, s *Sticker) (v1.Item, string, error) {
+	file, err := getFileURL(s.FileID, bot)
+	if err != nil {
+		return v1.Item{}, "", err
+	}
+
+	fileURL := getTelegramFileURL(bot, file)
+	format := getStickerFormat(s, file.FilePath)
+
+	var data []byte
+	if format == stickerStatic {
+		if data, err = downloadSticker(fileURL); err != nil {
+			return v1.Item{}, "", err
+		}
+
+		if detected := detectStickerFormat(data); detected != "" {
+			format = detected
+		}
+	}
+
+	switch format {
+	case stickerVideo:
+		item, _, err := getItemData(client, fileURL, "")
+		if err != nil {
+			return item, "", err
+		}
+
+		item.Caption = item.ID + ".webm"
+
+		return item, v1.MsgTypeFile, nil
+	case stickerAnimated:
+		thumb := s.getThumbnail()
+		if thumb == nil {
+			return v1.Item{}, "", errNoStickerPreview
+		}
+
+		thumbFile, err := getFileURL(thumb.FileID, bot)
+		if err != nil {
+			return v1.Item{}, "", err
+		}
+
+		if data, err = downloadSticker(getTelegramFileURL(bot, thumbFile)); err != nil {
+			return v1.Item{}, "", err
+		}
+	}
+
+	img, err := getStickerImage(data)
+	if err != nil {
+		return v1.Item{}, "", err
+	}
+
+	uploaded, _, err := client.UploadFile(bytes.NewReader(img))
+	if err != nil {
+		return v1.Item{}, "", err
+	}
+
+	return v1.Item{ID: uploaded.ID}, v1.MsgTypeImage, nil
+}
+
+// setStickerAttachment fills message with the sticker, sticker which can not be shown is replaced with its emoji
+func setStickerAttachment(s *Sticker, client *v1.MgClient, snd *v1.SendData, bot *tgbotapi.BotAPI) error {
+	item, msgType, err := uploadSticker(client, bot, s)
+	if err == errNoStickerPreview || err == errUnknownStickerType {
+		snd.Message.Type = v1.MsgTypeText
+		snd.Message.Text = strings.TrimSpace(getLocalizedMessage("sticker") + " " + s.Emoji)
+
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	snd.Message.Type = msgType
+	snd.Message.Items = []v1.Item{item}
+
+	return nil
+}
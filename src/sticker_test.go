@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/h2non/gock"
+	v1 "github.com/retailcrm/mg-transport-api-client-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readStickerFixture reads sticker file, tests run from the repository root
+func readStickerFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("src", "testdata", "stickers", name))
+	require.NoError(t, err)
+
+	return data
+}
+
+func TestSticker_detectStickerFormat(t *testing.T) {
+	assert.Equal(t, stickerStatic, detectStickerFormat(readStickerFixture(t, "static.webp")))
+	assert.Equal(t, stickerAnimated, detectStickerFormat(readStickerFixture(t, "animated.tgs")))
+	assert.Equal(t, stickerVideo, detectStickerFormat(readStickerFixture(t, "video.webm")))
+	assert.Empty(t, detectStickerFormat([]byte("plain text")))
+}
+
+func TestSticker_getStickerFormat(t *testing.T) {
+	assert.Equal(t, stickerVideo, getStickerFormat(&Sticker{IsVideo: true}, "stickers/file_1.webp"))
+	assert.Equal(t, stickerAnimated, getStickerFormat(&Sticker{IsAnimated: true}, ""))
+	assert.Equal(t, stickerAnimated, getStickerFormat(&Sticker{}, "stickers/file_1.tgs"))
+	assert.Equal(t, stickerVideo, getStickerFormat(&Sticker{}, "stickers/file_1.WEBM"))
+	assert.Equal(t, stickerStatic, getStickerFormat(&Sticker{}, "stickers/file_1.webp"))
+}
+
+func TestSticker_getStickerImage(t *testing.T) {
+	img, err := getStickerImage(readStickerFixture(t, "static.webp"))
+	require.NoError(t, err)
+
+	decoded, err := png.Decode(bytes.NewReader(img))
+	require.NoError(t, err)
+	assert.NotZero(t, decoded.Bounds().Dx())
+
+	_, err = getStickerImage(readStickerFixture(t, "animated.tgs"))
+	assert.Equal(t, errUnknownStickerType, err)
+}
+
+func TestSticker_uploadSticker_animated(t *testing.T) {
+	defer gock.Off()
+
+	bot := &tgbotapi.BotAPI{Token: "111:Token", Client: &http.Client{}}
+	gock.InterceptClient(bot.Client)
+
+	gock.New("https://api.telegram.org").
+		Post("/bot111:Token/getFile").
+		BodyString("file_id=thumb").
+		Reply(200).
+		BodyString(`{"ok":true,"result":{"file_id":"thumb","file_path":"thumbnails/file_1.webp"}}`)
+	gock.New("https://api.telegram.org").
+		Post("/bot111:Token/getFile").
+		Reply(200).
+		BodyString(`{"ok":true,"result":{"file_id":"sticker","file_path":"stickers/file_1.tgs"}}`)
+	gock.New("https://api.telegram.org").
+		Get("/file/bot111:Token/thumbnails/file_1.webp").
+		Reply(200).
+		Body(bytes.NewReader(readStickerFixture(t, "static.webp")))
+	gock.New(testMGURL).
+		Post("/files/upload").
+		Reply(200).
+		BodyString(`{"id":"png-file"}`)
+
+	s := &Sticker{
+		Sticker:    tgbotapi.Sticker{FileID: "sticker", Emoji: "👍"},
+		IsAnimated: true,
+		Thumb:      &tgbotapi.PhotoSize{FileID: "thumb"},
+	}
+
+	item, msgType, err := uploadSticker(newTestMGClient(), bot, s)
+	require.NoError(t, err)
+	assert.Equal(t, v1.MsgTypeImage, msgType)
+	assert.Equal(t, "png-file", item.ID)
+	assert.True(t, gock.IsDone())
+}
+
+func TestSticker_setStickerAttachment_noPreview(t *testing.T) {
+	defer gock.Off()
+	setLocale("en")
+
+	bot := &tgbotapi.BotAPI{Token: "111:Token", Client: &http.Client{}}
+	gock.InterceptClient(bot.Client)
+
+	gock.New("https://api.telegram.org").
+		Post("/bot111:Token/getFile").
+		Reply(200).
+		BodyString(`{"ok":true,"result":{"file_id":"sticker","file_path":"stickers/file_1.tgs"}}`)
+
+	snd := &v1.SendData{}
+	s := &Sticker{Sticker: tgbotapi.Sticker{FileID: "sticker", Emoji: "👍"}}
+
+	require.NoError(t, setStickerAttachment(s, newTestMGClient(), snd, bot))
+	assert.Equal(t, v1.MsgTypeText, snd.Message.Type)
+	assert.Equal(t, "[sticker] 👍", snd.Message.Text)
+	assert.Empty(t, snd.Message.Items)
+}
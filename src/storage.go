@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// StorageS3 keeps files in AWS S3 bucket
+	StorageS3 = "s3"
+	// StorageS3Compatible keeps files in bucket of S3 compatible service like MinIO
+	StorageS3Compatible = "s3_compatible"
+	// StorageLocal keeps files on disk and serves them by the transport
+	StorageLocal = "local"
+	// StorageMemory keeps files in memory until restart, for tests and development
+	StorageMemory = "memory"
+
+	// storageRoute is the path files of local and memory storages are served under
+	storageRoute            = "/files"
+	defaultLocalStoragePath = "./files"
+)
+
+var (
+	fileStorage     Storage
+	fileStorageOnce sync.Once
+)
+
+// Storage keeps files which must be publicly available to MG, like customer avatars
+type Storage interface {
+	// Put saves file and returns its public URL
+	Put(key string, body io.Reader, contentType string) (string, error)
+}
+
+// getStorage returns storage selected in config, nil if it can not be created
+func getStorage() Storage {
+	fileStorageOnce.Do(func() {
+		s, err := newStorage(config)
+		if err != nil {
+			logger.Error("storage:", err)
+			return
+		}
+
+		fileStorage = s
+	})
+
+	return fileStorage
+}
+
+func newStorage(c *TransportConfig) (Storage, error) {
+	switch c.Storage.Type {
+	case "", StorageS3:
+		return newS3Storage(c.ConfigAWS, c.ConfigAWS.ForcePathStyle), nil
+	case StorageS3Compatible:
+		if c.ConfigAWS.Endpoint == "" {
+			return nil, errors.New("endpoint of S3 compatible storage is not set")
+		}
+
+		return newS3Storage(c.ConfigAWS, true), nil
+	case StorageLocal:
+		return &localStorage{path: c.Storage.getPath(), host: c.HTTPServer.Host}, nil
+	case StorageMemory:
+		return newMemoryStorage(c.HTTPServer.Host), nil
+	default:
+		return nil, fmt.Errorf("unknown storage type %s", c.Storage.Type)
+	}
+}
+
+// setStorageRoutes serves files of the storages kept by the transport itself
+func setStorageRoutes(r *gin.Engine) {
+	switch s := getStorage().(type) {
+	case *localStorage:
+		r.Static(storageRoute, s.path)
+	case *memoryStorage:
+		r.GET(storageRoute+"/*key", s.handler)
+	}
+}
+
+func getStorageURL(host, key string) string {
+	return fmt.Sprintf("https://%s%s/%s", host, storageRoute, key)
+}
+
+// s3Storage uploads files to S3 bucket with public read access
+type s3Storage struct {
+	uploader *s3manager.Uploader
+	bucket   string
+	acl      string
+}
+
+func newS3Storage(c ConfigAWS, pathStyle bool) *s3Storage {
+	s3Config := &aws.Config{
+		Credentials: credentials.NewStaticCredentials(
+			c.AccessKeyID,
+			c.SecretAccessKey,
+			""),
+		Region:           aws.String(c.Region),
+		S3ForcePathStyle: aws.Bool(pathStyle),
+	}
+
+	if c.Endpoint != "" {
+		s3Config.Endpoint = aws.String(c.Endpoint)
+	}
+
+	acl := c.ACL
+	if acl == "" {
+		acl = "public-read"
+	}
+
+	return &s3Storage{
+		uploader: s3manager.NewUploader(session.Must(session.NewSession(s3Config))),
+		bucket:   c.Bucket,
+		acl:      acl,
+	}
+}
+
+func (s *s3Storage) Put(key string, body io.Reader, contentType string) (string, error) {
+	input := &s3manager.UploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        body,
+		ContentType: aws.String(contentType),
+	}
+
+	// bucket policy grants the access when ACL is disabled
+	if s.acl != "none" {
+		input.ACL = aws.String(s.acl)
+	}
+
+	result, err := s.uploader.Upload(input)
+	if err != nil {
+		return "", err
+	}
+
+	return result.Location, nil
+}
+
+// localStorage writes files to the directory served by the transport
+type localStorage struct {
+	path string
+	host string
+}
+
+func (s *localStorage) Put(key string, body io.Reader, contentType string) (string, error) {
+	key = strings.TrimPrefix(key, "/")
+	name := filepath.Join(s.path, filepath.FromSlash(key))
+	if !strings.HasPrefix(name, filepath.Clean(s.path)+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid file key %s", key)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return "", err
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		return "", err
+	}
+
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	return getStorageURL(s.host, key), nil
+}
+
+type memoryFile struct {
+	data        []byte
+	contentType string
+}
+
+// memoryStorage keeps files in memory and serves them by the transport
+type memoryStorage struct {
+	mu    sync.RWMutex
+	files map[string]memoryFile
+	host  string
+}
+
+func newMemoryStorage(host string) *memoryStorage {
+	return &memoryStorage{files: map[string]memoryFile{}, host: host}
+}
+
+func (s *memoryStorage) Put(key string, body io.Reader, contentType string) (string, error) {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+
+	key = strings.TrimPrefix(key, "/")
+
+	s.mu.Lock()
+	s.files[key] = memoryFile{data: data, contentType: contentType}
+	s.mu.Unlock()
+
+	return getStorageURL(s.host, key), nil
+}
+
+func (s *memoryStorage) get(key string) (memoryFile, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	f, ok := s.files[key]
+
+	return f, ok
+}
+
+func (s *memoryStorage) handler(c *gin.Context) {
+	f, ok := s.get(strings.TrimPrefix(c.Param("key"), "/"))
+	if !ok {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	c.Data(http.StatusOK, f.contentType, f.data)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorage_local(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := &localStorage{path: dir, host: "example.com"}
+
+	u, err := s.Put("avatars/1.jpg", strings.NewReader("image"), "image/jpeg")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/files/avatars/1.jpg", u)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "avatars", "1.jpg"))
+	require.NoError(t, err)
+	assert.Equal(t, "image", string(data))
+
+	_, err = s.Put("../1.jpg", strings.NewReader("image"), "image/jpeg")
+	assert.Error(t, err)
+}
+
+func TestStorage_memory(t *testing.T) {
+	s := newMemoryStorage("example.com")
+
+	u, err := s.Put("/1.jpg", strings.NewReader("image"), "image/jpeg")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/files/1.jpg", u)
+
+	r := gin.New()
+	r.GET(storageRoute+"/*key", s.handler)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/1.jpg", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/jpeg", w.Header().Get("Content-Type"))
+	assert.Equal(t, "image", w.Body.String())
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/2.jpg", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
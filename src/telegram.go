@@ -1,16 +1,34 @@
 package main
 
-import "github.com/go-telegram-bot-api/telegram-bot-api"
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+func getWebhookURL(b *Bot) string {
+	return "https://" + config.HTTPServer.Host + "/telegram/" + b.WebhookID
+}
+
+// setWebhook registers bot webhook, Telegram passes the secret back in X-Telegram-Bot-Api-Secret-Token header
+func setWebhook(bot *tgbotapi.BotAPI, b *Bot) (tgbotapi.APIResponse, error) {
+	params := url.Values{}
+	params.Set("url", getWebhookURL(b))
+	params.Set("secret_token", b.WebhookSecret)
+
+	return bot.MakeRequest("setWebhook", params)
+}
 
 //GetFileIDAndURL function
-func GetFileIDAndURL(token string, userID int) (fileID, fileURL string, err error) {
-	bot, err := tgbotapi.NewBotAPI(token)
+func GetFileIDAndURL(b *Bot, userID int) (fileID, fileURL string, err error) {
+	bot, err := getBotAPI(b)
 	if err != nil {
 		return
 	}
 
-	bot.Debug = config.Debug
-
 	res, err := bot.GetUserProfilePhotos(
 		tgbotapi.UserProfilePhotosConfig{
 			UserID: userID,
@@ -33,7 +51,7 @@ func GetFileIDAndURL(token string, userID int) (fileID, fileURL string, err erro
 	return
 }
 
-func getMessageID(data *tgbotapi.Message) string {
+func getMessageID(data *Message) string {
 	switch {
 	case data.Sticker != nil:
 		return "sticker"
@@ -45,10 +63,16 @@ func getMessageID(data *tgbotapi.Message) string {
 		return "animation"
 	case data.Document != nil:
 		return "document"
+	case data.Venue != nil:
+		return "venue"
 	case data.Location != nil:
 		return "location"
+	case data.Poll != nil:
+		return "poll"
 	case data.Video != nil:
 		return "video"
+	case data.VideoNote != nil:
+		return "video_note"
 	case data.Voice != nil:
 		return "voice"
 	case data.Photo != nil:
@@ -57,3 +81,147 @@ func getMessageID(data *tgbotapi.Message) string {
 		return "undefined"
 	}
 }
+
+func getMapURL(l tgbotapi.Location) string {
+	return fmt.Sprintf("https://maps.google.com/maps?q=%f,%f", l.Latitude, l.Longitude)
+}
+
+// getStructuredMessageText describes location, venue, contact or poll as text for the operator
+func getStructuredMessageText(m *Message, t string) string {
+	lines := []string{getLocalizedMessage(t)}
+
+	switch t {
+	case "location":
+		lines = append(lines, getMapURL(*m.Location))
+	case "venue":
+		lines = append(lines, m.Venue.Title)
+		if m.Venue.Address != "" {
+			lines = append(lines, m.Venue.Address)
+		}
+
+		lines = append(lines, getMapURL(m.Venue.Location))
+	case "contact":
+		lines = append(lines, strings.TrimSpace(m.Contact.FirstName+" "+m.Contact.LastName), m.Contact.PhoneNumber)
+	case "poll":
+		lines = append(lines, m.Poll.Question)
+		for k, v := range m.Poll.Options {
+			lines = append(lines, fmt.Sprintf("%d. %s", k+1, v.Text))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// getReplyMarkup builds keyboard from MG suggestions, inline keyboard is used when there is a link,
+// quick replies become callback buttons then and their title is sent to MG when customer taps them
+func getReplyMarkup(suggestions []Suggestion) interface{} {
+	var inline bool
+
+	for _, s := range suggestions {
+		if s.Type == SuggestionTypeURL {
+			inline = true
+		}
+	}
+
+	if inline {
+		var rows [][]tgbotapi.InlineKeyboardButton
+
+		for i, s := range suggestions {
+			switch {
+			case s.Title == "":
+				continue
+			case s.Type == SuggestionTypeURL:
+				rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonURL(s.Title, s.Payload)))
+			case s.Type == SuggestionTypePhone:
+				// Telegram can ask for a phone number only with reply keyboard
+				continue
+			default:
+				rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(s.Title, getCallbackData(s, i))))
+			}
+		}
+
+		if len(rows) == 0 {
+			return nil
+		}
+
+		return tgbotapi.NewInlineKeyboardMarkup(rows...)
+	}
+
+	var rows [][]tgbotapi.KeyboardButton
+
+	for _, s := range suggestions {
+		if s.Title == "" {
+			continue
+		}
+
+		button := tgbotapi.NewKeyboardButton(s.Title)
+		if s.Type == SuggestionTypePhone {
+			button = tgbotapi.NewKeyboardButtonContact(s.Title)
+		}
+
+		rows = append(rows, tgbotapi.NewKeyboardButtonRow(button))
+	}
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	keyboard := tgbotapi.NewReplyKeyboard(rows...)
+	keyboard.OneTimeKeyboard = true
+
+	return keyboard
+}
+
+// getCallbackData returns payload of inline button, Telegram limits it to 64 bytes
+func getCallbackData(s Suggestion, i int) string {
+	if s.Payload != "" && len(s.Payload) <= 64 {
+		return s.Payload
+	}
+
+	return strconv.Itoa(i)
+}
+
+// setReplyMarkup attaches keyboard to message, media groups can not have one
+func setReplyMarkup(m tgbotapi.Chattable, markup interface{}) tgbotapi.Chattable {
+	if markup == nil {
+		return m
+	}
+
+	switch msg := m.(type) {
+	case tgbotapi.MessageConfig:
+		msg.ReplyMarkup = markup
+		return msg
+	case tgbotapi.PhotoConfig:
+		msg.ReplyMarkup = markup
+		return msg
+	case tgbotapi.DocumentConfig:
+		msg.ReplyMarkup = markup
+		return msg
+	case tgbotapi.VideoConfig:
+		msg.ReplyMarkup = markup
+		return msg
+	case tgbotapi.AudioConfig:
+		msg.ReplyMarkup = markup
+		return msg
+	case tgbotapi.VoiceConfig:
+		msg.ReplyMarkup = markup
+		return msg
+	default:
+		return m
+	}
+}
+
+// getCallbackButtonText returns title of the inline button customer tapped
+func getCallbackButtonText(q *CallbackQuery) string {
+	if q.Message != nil && q.Message.ReplyMarkup != nil {
+		for _, row := range q.Message.ReplyMarkup.InlineKeyboard {
+			for _, button := range row {
+				if button.CallbackData != nil && *button.CallbackData == q.Data {
+					return button.Text
+				}
+			}
+		}
+	}
+
+	return q.Data
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTelegram_getStructuredMessageText(t *testing.T) {
+	setLocale("en")
+
+	location := &Message{Message: tgbotapi.Message{Location: &tgbotapi.Location{Latitude: 55.75, Longitude: 37.61}}}
+	assert.Equal(t, "[location]\nhttps://maps.google.com/maps?q=55.750000,37.610000", getStructuredMessageText(location, getMessageID(location)))
+
+	venue := &Message{Message: tgbotapi.Message{
+		Location: &tgbotapi.Location{Latitude: 1, Longitude: 2},
+		Venue: &tgbotapi.Venue{
+			Location: tgbotapi.Location{Latitude: 1, Longitude: 2},
+			Title:    "Cafe",
+			Address:  "Main street, 1",
+		},
+	}}
+	assert.Equal(t, "venue", getMessageID(venue))
+	assert.Equal(t, "[venue]\nCafe\nMain street, 1\nhttps://maps.google.com/maps?q=1.000000,2.000000", getStructuredMessageText(venue, "venue"))
+
+	contact := &Message{Message: tgbotapi.Message{Contact: &tgbotapi.Contact{FirstName: "John", PhoneNumber: "+79990000000"}}}
+	assert.Equal(t, "[contact]\nJohn\n+79990000000", getStructuredMessageText(contact, getMessageID(contact)))
+
+	poll := &Message{Poll: &Poll{Question: "Color?", Options: []PollOption{{Text: "Red"}, {Text: "Blue"}}}}
+	assert.Equal(t, "[poll]\nColor?\n1. Red\n2. Blue", getStructuredMessageText(poll, getMessageID(poll)))
+}
+
+func TestTelegram_getReplyMarkup(t *testing.T) {
+	assert.Nil(t, getReplyMarkup(nil))
+
+	reply, ok := getReplyMarkup([]Suggestion{
+		{Type: SuggestionTypeText, Title: "Track order"},
+		{Type: SuggestionTypePhone, Title: "Share phone"},
+		{Type: SuggestionTypeEmail, Title: "Send email"},
+	}).(tgbotapi.ReplyKeyboardMarkup)
+	assert.True(t, ok)
+	assert.True(t, reply.OneTimeKeyboard)
+	assert.Equal(t, "Track order", reply.Keyboard[0][0].Text)
+	assert.True(t, reply.Keyboard[1][0].RequestContact)
+	assert.Equal(t, "Send email", reply.Keyboard[2][0].Text)
+	assert.False(t, reply.Keyboard[2][0].RequestContact)
+
+	inline, ok := getReplyMarkup([]Suggestion{
+		{Type: SuggestionTypeText, Title: "Talk to manager"},
+		{Type: SuggestionTypeURL, Title: "Site", Payload: "https://example.com"},
+		{Type: SuggestionTypePhone, Title: "Share phone"},
+	}).(tgbotapi.InlineKeyboardMarkup)
+	assert.True(t, ok)
+	assert.Len(t, inline.InlineKeyboard, 2)
+	assert.Equal(t, "0", *inline.InlineKeyboard[0][0].CallbackData)
+	assert.Equal(t, "https://example.com", *inline.InlineKeyboard[1][0].URL)
+
+	q := &CallbackQuery{
+		CallbackQuery: tgbotapi.CallbackQuery{Data: "0"},
+		Message:       &Message{ReplyMarkup: &inline},
+	}
+	assert.Equal(t, "Talk to manager", getCallbackButtonText(q))
+}
+
+func TestTelegram_channelSuggestions(t *testing.T) {
+	data, err := json.Marshal(getChannelSettings())
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"suggestions":{"text":"send","phone":"send","email":"send","url":"send"}`)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Update is Telegram update with fields of newer Bot API versions than tgbotapi supports
+type Update struct {
+	tgbotapi.Update
+	Message       *Message           `json:"message"`
+	EditedMessage *Message           `json:"edited_message"`
+	CallbackQuery *CallbackQuery     `json:"callback_query"`
+	MyChatMember  *ChatMemberUpdated `json:"my_chat_member"`
+}
+
+// Message is Telegram message with fields missing in tgbotapi.Message
+type Message struct {
+	tgbotapi.Message
+	Poll               *Poll                          `json:"poll"`
+	Sticker            *Sticker                       `json:"sticker"`
+	ReplyMarkup        *tgbotapi.InlineKeyboardMarkup `json:"reply_markup"`
+	CaptionEntities    []tgbotapi.MessageEntity       `json:"caption_entities"`
+	SenderChat         *tgbotapi.Chat                 `json:"sender_chat"`
+	MessageThreadID    int                            `json:"message_thread_id"`
+	IsTopicMessage     bool                           `json:"is_topic_message"`
+	ForumTopicCreated  *json.RawMessage               `json:"forum_topic_created"`
+	ForumTopicEdited   *json.RawMessage               `json:"forum_topic_edited"`
+	ForumTopicClosed   *json.RawMessage               `json:"forum_topic_closed"`
+	ForumTopicReopened *json.RawMessage               `json:"forum_topic_reopened"`
+}
+
+// isReplyToTopic returns true if message replies to the topic creation message,
+// Telegram sets it for every message of the topic which is not an explicit reply
+func (m *Message) isReplyToTopic() bool {
+	return m.IsTopicMessage && m.ReplyToMessage != nil && m.ReplyToMessage.MessageID == m.MessageThreadID
+}
+
+// ChatMemberUpdated is sent when status of the bot in the chat changes,
+// in private chats it means customer blocked or restarted the bot
+type ChatMemberUpdated struct {
+	Chat          tgbotapi.Chat       `json:"chat"`
+	From          tgbotapi.User       `json:"from"`
+	Date          int                 `json:"date"`
+	OldChatMember tgbotapi.ChatMember `json:"old_chat_member"`
+	NewChatMember tgbotapi.ChatMember `json:"new_chat_member"`
+}
+
+// isBlocked returns true if the bot can not write to the chat anymore
+func (u *ChatMemberUpdated) isBlocked() bool {
+	return u.NewChatMember.Status == "kicked" || u.NewChatMember.Status == "left"
+}
+
+// CallbackQuery is sent when customer taps inline keyboard button
+type CallbackQuery struct {
+	tgbotapi.CallbackQuery
+	Message *Message `json:"message"`
+}
+
+// Poll contains information about a poll
+type Poll struct {
+	ID          string       `json:"id"`
+	Question    string       `json:"question"`
+	Options     []PollOption `json:"options"`
+	IsClosed    bool         `json:"is_closed"`
+	IsAnonymous bool         `json:"is_anonymous"`
+	Type        string       `json:"type"`
+}
+
+// PollOption contains information about one answer option in a poll
+type PollOption struct {
+	Text       string `json:"text"`
+	VoterCount int    `json:"voter_count"`
+}
+
+func parseUpdate(payload []byte) (Update, error) {
+	var update Update
+	err := json.Unmarshal(payload, &update)
+
+	return update, err
+}
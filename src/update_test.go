@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdate_myChatMember(t *testing.T) {
+	update, err := parseUpdate([]byte(`{
+		"update_id": 1,
+		"my_chat_member": {
+			"chat": {"id": 123, "type": "private"},
+			"from": {"id": 123, "first_name": "Customer"},
+			"date": 1588750000,
+			"old_chat_member": {"user": {"id": 1, "is_bot": true}, "status": "member"},
+			"new_chat_member": {"user": {"id": 1, "is_bot": true}, "status": "kicked"}
+		}
+	}`))
+	require.NoError(t, err)
+	require.NotNil(t, update.MyChatMember)
+
+	assert.True(t, update.MyChatMember.isBlocked())
+	assert.True(t, update.MyChatMember.Chat.IsPrivate())
+	assert.Equal(t, int64(123), getUpdateChatID(update))
+
+	update.MyChatMember.NewChatMember.Status = "member"
+	assert.False(t, update.MyChatMember.isBlocked())
+}
@@ -11,11 +11,6 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/retailcrm/api-client-go/v5"
 )
 
@@ -25,7 +20,6 @@ var (
 		"/api/integration-modules/{code}",
 		"/api/integration-modules/{code}/edit",
 	}
-	markdownSymbols = []string{"*", "_", "`", "["}
 )
 
 // GenerateToken function
@@ -89,41 +83,22 @@ func checkCredentials(credential []string) []string {
 
 //UploadUserAvatar function
 func UploadUserAvatar(url string) (picURLs3 string, err error) {
-	s3Config := &aws.Config{
-		Credentials: credentials.NewStaticCredentials(
-			config.ConfigAWS.AccessKeyID,
-			config.ConfigAWS.SecretAccessKey,
-			""),
-		Region: aws.String(config.ConfigAWS.Region),
+	storage := getStorage()
+	if storage == nil {
+		return "", errors.New("storage is not configured")
 	}
 
-	s := session.Must(session.NewSession(s3Config))
-	uploader := s3manager.NewUploader(s)
-
-	resp, err := http.Get(url)
-	if err != nil {
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= http.StatusBadRequest {
-		return "", errors.New(fmt.Sprintf("get: %v code: %v", url, resp.StatusCode))
-	}
-
-	result, err := uploader.Upload(&s3manager.UploadInput{
-		Bucket:      aws.String(config.ConfigAWS.Bucket),
-		Key:         aws.String(fmt.Sprintf("%v/%v.jpg", config.ConfigAWS.FolderName, GenerateToken())),
-		Body:        resp.Body,
-		ContentType: aws.String(config.ConfigAWS.ContentType),
-		ACL:         aws.String("public-read"),
-	})
+	body, err := fetchFile(url, maxAvatarSize)
 	if err != nil {
 		return
 	}
+	defer body.Close()
 
-	picURLs3 = result.Location
-
-	return
+	return storage.Put(
+		fmt.Sprintf("%v/%v.jpg", config.ConfigAWS.FolderName, GenerateToken()),
+		body,
+		config.ConfigAWS.ContentType,
+	)
 }
 
 func getChannelSettingsHash() (hash string, err error) {
@@ -136,23 +111,26 @@ func getChannelSettingsHash() (hash string, err error) {
 	return
 }
 
-func replaceMarkdownSymbols(s string) string {
-	for _, v := range markdownSymbols {
-		s = strings.Replace(s, v, "\\"+v, -1)
-	}
+// getIntegrationModuleHash returns hash of the integration module registered for the connection in retailCRM
+func getIntegrationModuleHash(clientID string) string {
+	res, _ := json.Marshal(getIntegrationModule(clientID))
 
-	return s
+	return fmt.Sprintf("%x", sha1.Sum(res))
 }
 
 // shouldMessageBeIgnored returns true if message should not be processed at all
-func shouldMessageBeIgnored(m *tgbotapi.Message) bool {
+func shouldMessageBeIgnored(m *Message) bool {
 	if m.NewChatMembers != nil ||
 		m.LeftChatMember != nil ||
 		m.NewChatTitle != "" ||
 		m.NewChatPhoto != nil ||
 		m.PinnedMessage != nil ||
 		m.DeleteChatPhoto ||
-		m.GroupChatCreated {
+		m.GroupChatCreated ||
+		m.ForumTopicCreated != nil ||
+		m.ForumTopicEdited != nil ||
+		m.ForumTopicClosed != nil ||
+		m.ForumTopicReopened != nil {
 		return true
 	}
 
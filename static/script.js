@@ -1,4 +1,4 @@
-$(document).on("change", "select", function(e) {
+$(document).on("change", ".sel-lang select", function(e) {
     send(
         "/set-lang/",
         {
@@ -11,6 +11,32 @@ $(document).on("change", "select", function(e) {
     )
 });
 
+$(document).on("change", ".sel-group-mode select", function(e) {
+    send(
+        "/set-group-mode/",
+        {
+            token: $(this).attr("data-token"),
+            groupMode: $(this).val()
+        },
+        function () {
+            return 0;
+        }
+    )
+});
+
+$(document).on("change", ".sel-update-mode select", function(e) {
+    send(
+        "/set-update-mode/",
+        {
+            token: $(this).attr("data-token"),
+            mode: $(this).val()
+        },
+        function () {
+            return 0;
+        }
+    )
+});
+
 $('#save-crm').on("submit", function(e) {
     e.preventDefault();
     let formData = formDataToObj($(this).serializeArray());
@@ -112,9 +138,16 @@ $(document).on("click", ".delete-bot", function(e) {
 });
 
 function send(url, data, callback) {
+    let headers = {};
+    let csrfToken = $("#csrf-token").val();
+    if (csrfToken) {
+        headers["X-CSRF-Token"] = csrfToken;
+    }
+
     $.ajax({
         url: url,
         data: JSON.stringify(data),
+        headers: headers,
         type: "POST",
         success: callback,
         error: function (res){
@@ -145,6 +178,20 @@ function getBotTemplate(data) {
                     </select>
                 </div>
             </td>
+            <td>
+                <div class="col s3 sel-group-mode">
+                    <select data-token="${data.token}">
+                        ${$("#group-mode-options").html()}
+                    </select>
+                </div>
+            </td>
+            <td>
+                <div class="col s3 sel-update-mode">
+                    <select data-token="${data.token}">
+                        ${$("#update-mode-options").html()}
+                    </select>
+                </div>
+            </td>
             <td>
                 <button class="delete-bot btn btn-small waves-effect waves-light light-blue darken-1" type="submit" name="action"
                         data-token="${data.token}">